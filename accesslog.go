@@ -0,0 +1,192 @@
+package slicesync
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	REQUEST_ID_HEADER = "X-Request-Id" // Request and response header with the request id, to correlate logs
+	MAX_REQUEST_ID    = 64             // Longer request ids from clients are replaced
+	LOG_COMMON        = "common"       // Common log format access logs
+	LOG_JSON          = "json"         // JSON access logs
+)
+
+// AccessLog, when not nil, receives a line for each request served, in AccessLogFormat
+var AccessLog io.Writer
+
+// AccessLogFormat is either LOG_COMMON or LOG_JSON
+//
+// Common log format lines are followed by the quoted requested range, the duration in seconds and the request id:
+//
+//	127.0.0.1 - alice [10/Oct/2023:13:55:36 +0000] "GET /file HTTP/1.1" 206 1024 "bytes=0-1023" 0.000213 4f2a...
+var AccessLogFormat = LOG_COMMON
+
+// accessLogMutex serializes the writes to AccessLog
+var accessLogMutex sync.Mutex
+
+// contextKey is the type of the request context keys of this package
+type contextKey int
+
+// userKey is the request context key of the name authenticated for the request, set by trace and filled by guard
+const userKey contextKey = 0
+
+// accessEntry is an access log entry
+type accessEntry struct {
+	Time      time.Time `json:"time"`
+	RequestId string    `json:"request_id"`
+	Client    string    `json:"client"`
+	User      string    `json:"user,omitempty"` // name authenticated, if any
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Protocol  string    `json:"protocol"`
+	Range     string    `json:"range,omitempty"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Duration  float64   `json:"duration"` // seconds
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+// common returns the entry as a common log format line, followed by the range, duration and request id
+func (e *accessEntry) common() string {
+	user, rng := "-", "-"
+	if e.User != "" {
+		user = e.User
+	}
+	if e.Range != "" {
+		rng = e.Range
+	}
+	return fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %d %q %.6f %s\n", e.Client, user,
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"), e.Method, e.Path, e.Protocol, e.Status, e.Bytes, rng,
+		e.Duration, e.RequestId)
+}
+
+// logAccess writes the entry to AccessLog
+func logAccess(e *accessEntry) {
+	line := e.common()
+	if AccessLogFormat == LOG_JSON {
+		data, _ := json.Marshal(e)
+		line = string(data) + "\n"
+	}
+	accessLogMutex.Lock()
+	defer accessLogMutex.Unlock()
+	io.WriteString(AccessLog, line)
+}
+
+// NewRequestId returns a new random request id
+func NewRequestId() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// requestId returns the request id sent by the client, if valid, or a new one
+func requestId(r *http.Request) string {
+	id := r.Header.Get(REQUEST_ID_HEADER)
+	if id == "" || len(id) > MAX_REQUEST_ID {
+		return NewRequestId()
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' ||
+			c == '.') {
+			return NewRequestId()
+		}
+	}
+	return id
+}
+
+// statusWriter records the status and bytes sent of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+// WriteHeader for statusWriter's http.ResponseWriter implementation
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// Write for statusWriter's http.ResponseWriter implementation
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(p)
+	sw.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom forwards to the io.ReaderFrom of the ResponseWriter, if any, so that files are still sent with sendfile
+func (sw *statusWriter) ReadFrom(r io.Reader) (int64, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	var n int64
+	var err error
+	if rf, ok := sw.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(sw.ResponseWriter, r)
+	}
+	sw.bytes += n
+	return n, err
+}
+
+// Flush forwards to the http.Flusher of the ResponseWriter, if any
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// trace wraps h to tag each request and response with a request id, count them in the metrics
+// and log them to AccessLog, if any (prefix is the url prefix of the files served)
+func trace(prefix string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := requestId(r)
+		w.Header().Set(REQUEST_ID_HEADER, id)
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		user := new(string)
+		r = r.WithContext(context.WithValue(r.Context(), userKey, user))
+		h.ServeHTTP(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		served(requestKind(r, prefix), r.Header.Get("Range") != "", sw.bytes)
+		if AccessLog == nil {
+			return
+		}
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+		logAccess(&accessEntry{start, id, client, *user, r.Method, r.URL.RequestURI(), r.Proto,
+			r.Header.Get("Range"), sw.status, sw.bytes, time.Since(start).Seconds(), r.UserAgent()})
+	})
+}
+
+// authenticated records name as authenticated for r, for trace to log it
+func authenticated(r *http.Request, name string) {
+	if user, ok := r.Context().Value(userKey).(*string); ok {
+		*user = name
+	}
+}
+
+// ClientRequestId makes all requests to servers carry the request id, so that the server logs
+// of all the requests of a sync can be correlated (call it after ClientTLS, if used)
+func ClientRequestId(id string) {
+	clientHeader(REQUEST_ID_HEADER, id)
+}
@@ -0,0 +1,97 @@
+package slicesync
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// ADMIN_PATH is the url path prefix of the admin API
+const ADMIN_PATH = "/admin/"
+
+// AdminAccess, when not nil, makes HashNServe serve the admin API of its hashing service (see AdminHandler),
+// to those authenticated and authorized by it, as for files at the paths of the admin endpoints
+var AdminAccess *AccessControl
+
+// AdminPort is the port HashNServe serves the admin API on, along with the files when 0
+var AdminPort = 0
+
+// AdminHandler serves the JSON admin API of service under ADMIN_PATH, only to requests authorized by ac:
+//
+//	GET  /admin/status            HashingStatus of the service
+//	GET  /admin/files             ManagedFile list of the files and their hash dumps status
+//	POST /admin/rehash?path=dir   Forces path to be hashed again (see HashingService.Rehash)
+//	POST /admin/pause             Pauses hashing
+//	POST /admin/resume            Resumes hashing
+//	GET  /admin/metrics           Metrics in Prometheus text format, as served at MetricsPath
+//
+// All POST endpoints reply with the resulting HashingStatus
+// Admin requests are logged to AccessLog and counted in the metrics as those for files
+func AdminHandler(service *HashingService, ac *AccessControl) http.Handler {
+	smux := http.NewServeMux()
+	smux.HandleFunc(ADMIN_PATH+"status", adminGet(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, service.Status())
+	}))
+	smux.HandleFunc(ADMIN_PATH+"files", adminGet(func(w http.ResponseWriter, r *http.Request) {
+		files, err := service.Files()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, files)
+	}))
+	smux.HandleFunc(ADMIN_PATH+"rehash", adminPost(func(w http.ResponseWriter, r *http.Request) {
+		if err := service.Rehash(r.FormValue("path")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, service.Status())
+	}))
+	smux.HandleFunc(ADMIN_PATH+"pause", adminPost(func(w http.ResponseWriter, r *http.Request) {
+		service.Pause()
+		writeJSON(w, http.StatusOK, service.Status())
+	}))
+	smux.HandleFunc(ADMIN_PATH+"resume", adminPost(func(w http.ResponseWriter, r *http.Request) {
+		service.Resume()
+		writeJSON(w, http.StatusOK, service.Status())
+	}))
+	smux.HandleFunc(ADMIN_PATH+"metrics", adminGet(serveMetrics))
+	return trace(ADMIN_PATH, ac.guard(ADMIN_PATH, smux))
+}
+
+// adminGet wraps an admin endpoint handler fn to only accept GET and HEAD requests
+func adminGet(fn http.HandlerFunc) http.HandlerFunc {
+	return adminMethods(fn, "GET", "HEAD")
+}
+
+// adminPost wraps an admin endpoint handler fn to only accept POST requests
+func adminPost(fn http.HandlerFunc) http.HandlerFunc {
+	return adminMethods(fn, "POST")
+}
+
+// adminMethods wraps an admin endpoint handler fn to only accept the given methods
+func adminMethods(fn http.HandlerFunc, methods ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !contains(methods, r.Method) {
+			w.Header().Set("Allow", strings.Join(methods, ", "))
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+// writeJSON replies with status and v as JSON
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// withAdmin returns h serving the admin API handler admin under ADMIN_PATH as well
+func withAdmin(h, admin http.Handler) http.Handler {
+	smux := http.NewServeMux()
+	smux.Handle("/", h)
+	smux.Handle(ADMIN_PATH, admin)
+	return smux
+}
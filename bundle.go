@@ -0,0 +1,140 @@
+package slicesync
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// WriteBundle writes into w the delta bundle of filename at dir following the diffs plan:
+// the plan itself as a JSON line followed by the contents of all its different segments, in order
+func WriteBundle(w io.Writer, dir, filename string, diffs *Diffs) error {
+	hnd := &LocalHashNDump{dir}
+	if err := json.NewEncoder(w).Encode(diffs); err != nil {
+		return err
+	}
+	for _, diff := range diffs.Diffs {
+		if !diff.Different {
+			continue
+		}
+		rc, _, err := hnd.Dump(filename, diff.Offset, diff.Size)
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(w, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		if n != diff.Size {
+			return fmt.Errorf("Expected to bundle %v but bundled %v instead!", diff.Size, n)
+		}
+	}
+	return nil
+}
+
+// checkBundle checks that all the different segments in the diffs plan are within filename at dir
+func checkBundle(dir, filename string, diffs *Diffs) error {
+	hnd := &LocalHashNDump{dir}
+	rc, size, err := hnd.Dump(filename, 0, 0)
+	if err != nil {
+		return err
+	}
+	rc.Close()
+	for _, diff := range diffs.Diffs {
+		if diff.Different && (diff.Offset < 0 || diff.Size <= 0 || diff.Offset+diff.Size > size) {
+			return fmt.Errorf("Segment %v+%v is not within the %v bytes of %v!", diff.Offset, diff.Size, size, filename)
+		}
+	}
+	return nil
+}
+
+// serveBundle serves the delta bundle of the requested file following the Diffs plan POSTed by the client,
+// or calculating the plan from the POSTed alike hash dump instead
+// The bundle is gzip compressed when the client accepts it
+func serveBundle(dir string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "POST the Diffs plan or the alike hash dump to get the bundle", http.StatusMethodNotAllowed)
+		return
+	}
+	body := http.MaxBytesReader(w, r.Body, MAX_UPLOADED_DUMP)
+	var diffs *Diffs
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		diffs = &Diffs{}
+		err = json.NewDecoder(body).Decode(diffs)
+	} else {
+		diffs, err = DumpDiffs(dir, r.URL.Path, r.URL.Query().Get("alike"), body)
+	}
+	if err == nil {
+		err = checkBundle(dir, r.URL.Path, diffs)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	var out io.Writer = w
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		out = gz
+	}
+	WriteBundle(out, dir, r.URL.Path, diffs)
+}
+
+// bundleReader reads the different segments contents from a delta bundle response
+type bundleReader struct {
+	*bufio.Reader
+	io.Closer
+}
+
+// Bundle returns the remote delta bundle contents of all the different segments in the diffs plan, in order,
+// in a single request (only servers supporting the "bundle" slicesync extension can do it, such as syncserver)
+func (rhnd *RemoteHashNDump) Bundle(diffs *Diffs) (io.ReadCloser, error) {
+	if !supports(rhnd.Server, BUNDLE) {
+		return nil, fmt.Errorf("Remote server %v does not serve bundles!", rhnd.Server)
+	}
+	plan, err := json.Marshal(diffs)
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{}
+	query.Set(SLICESYNC_PARAM, BUNDLE)
+	bundleUrl := calcUrl(rhnd.Server, diffs.Filename) + "?" + query.Encode()
+	req, err := http.NewRequest("POST", bundleUrl, bytes.NewReader(plan))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	acceptEncoding(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Error %v getting the bundle for %v!", resp.Status, diffs.Filename)
+	}
+	body, err := decode(resp)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(body)
+	bundled := &Diffs{}
+	if line, err := r.ReadBytes('\n'); err != nil || json.Unmarshal(line, bundled) != nil ||
+		bundled.Differences != diffs.Differences || len(bundled.Diffs) != len(diffs.Diffs) {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Bundle for %v does not follow the requested Diffs plan!", diffs.Filename)
+	}
+	return &bundleReader{r, resp.Body}, nil
+}
@@ -0,0 +1,168 @@
+package slicesync
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	FASTCDC = "fastcdc"
+)
+
+// ContentDefinedChunking makes HashFile cut content defined chunks (FastCDC) of slice size on average,
+// instead of fixed size slices, so that an insertion or deletion only changes the chunks around it
+var ContentDefinedChunking = false
+
+// gear is the FastCDC random table for the gear rolling hash (always generated the same way)
+var gear [256]uint64
+
+func init() {
+	seed := uint64(0x736c696365737963) // splitmix64
+	for i := range gear {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// CDC holds the content defined chunking parameters: chunks are from Min to Max bytes long, Avg on average
+type CDC struct {
+	Min, Avg, Max int64
+}
+
+// NewCDC returns the chunking parameters for chunks of slice size on average
+func NewCDC(slice int64) *CDC {
+	min := slice / 4
+	if min < 1 {
+		min = 1
+	}
+	return &CDC{min, slice, slice * 4}
+}
+
+// String returns the CDC as declared in the .slicesync header Chunking attribute
+func (c *CDC) String() string {
+	return fmt.Sprintf("%s %v %v %v", FASTCDC, c.Min, c.Avg, c.Max)
+}
+
+// parseCDC parses a .slicesync header Chunking attribute value
+func parseCDC(value string) (*CDC, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 4 || fields[0] != FASTCDC {
+		return nil, fmt.Errorf("Unsupported chunking %s!", value)
+	}
+	sizes := make([]int64, 3)
+	for i := range sizes {
+		size, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		sizes[i] = size
+	}
+	if sizes[0] < 1 || sizes[0] > sizes[1] || sizes[1] > sizes[2] {
+		return nil, fmt.Errorf("Invalid chunking sizes %s!", value)
+	}
+	return &CDC{sizes[0], sizes[1], sizes[2]}, nil
+}
+
+// masks returns the FastCDC normalized chunking masks:
+// the harder one used before reaching Avg and the easier one after it
+func (c *CDC) masks() (small, large uint64) {
+	bits := uint(0)
+	for avg := c.Avg; avg > 1; avg >>= 1 {
+		bits++
+	}
+	if bits < 2 {
+		bits = 2
+	}
+	return ^uint64(0) << (64 - bits - 1), ^uint64(0) << (64 - bits + 1)
+}
+
+// cut returns the length of the chunk at the start of data
+// (data must hold at least Max bytes unless it is the end of the content)
+func (c *CDC) cut(data []byte) int {
+	n := len(data)
+	if int64(n) <= c.Min {
+		return n
+	}
+	if int64(n) > c.Max {
+		n = int(c.Max)
+	}
+	normal := int(c.Avg)
+	if normal > n {
+		normal = n
+	}
+	small, large := c.masks()
+	fp := uint64(0)
+	i := int(c.Min)
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&small == 0 {
+			return i
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&large == 0 {
+			return i
+		}
+	}
+	return n
+}
+
+// chunks cuts r into content defined chunks, calling fn with each of them in order
+func (c *CDC) chunks(r io.Reader, fn func(offset int64, data []byte) error) error {
+	br := bufio.NewReaderSize(r, int(c.Max))
+	offset := int64(0)
+	for {
+		data, err := br.Peek(int(c.Max))
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(data) == 0 {
+			return nil
+		}
+		n := c.cut(data)
+		if err := fn(offset, data[:n]); err != nil {
+			return err
+		}
+		br.Discard(n)
+		offset += int64(n)
+	}
+}
+
+// dump writes a "offset length hash" line for each chunk of file into w, feeding the whole file hash h as well
+func (c *CDC) dump(w *bufio.Writer, file io.Reader, h io.Writer, sliceHash NamedHash) error {
+	return c.chunks(file, func(offset int64, data []byte) error {
+		h.Write(data)
+		fmt.Fprintf(w, "%v %v %s\n", offset, len(data), chunkHash(sliceHash, data))
+		return w.Flush()
+	})
+}
+
+// chunkHash returns the base64 slice hash of a chunk
+func chunkHash(sliceHash NamedHash, data []byte) string {
+	sliceHash.Reset()
+	sliceHash.Write(data)
+	return base64.StdEncoding.EncodeToString(sliceHash.Sum(nil))
+}
+
+// parseChunk parses a chunked hash dump "offset length hash" line
+func parseChunk(line string) (offset, size int64, hash string, err error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 {
+		return 0, 0, "", fmt.Errorf("Chunk expected, but got %s!", line)
+	}
+	if offset, err = strconv.ParseInt(fields[0], 10, 64); err != nil {
+		return 0, 0, "", err
+	}
+	if size, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+		return 0, 0, "", err
+	}
+	return offset, size, fields[2], nil
+}
@@ -0,0 +1,154 @@
+package slicesync
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	LENGTH_HEADER = "X-Slicesync-Length" // Response header keeping the decoded length of compressed responses
+)
+
+// Compress makes the server gzip its whole file responses (hash dumps, files and bundles) to clients accepting it
+var Compress = true
+
+// compressedTypes are the content type prefixes of contents already compressed, not worth gzipping again
+var compressedTypes = []string{"image/", "video/", "audio/", "application/zip", "application/gzip",
+	"application/x-gzip", "application/x-bzip2", "application/x-xz", "application/x-7z-compressed",
+	"application/x-rar-compressed", "application/zstd", "font/woff"}
+
+// compress gzips the responses of h when Compress is set and the client accepts it
+func compress(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !Compress || r.Method != "GET" || !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		gzw := &gzipResponseWriter{ResponseWriter: w}
+		defer gzw.Close()
+		h.ServeHTTP(gzw, r)
+	})
+}
+
+// gzipResponseWriter gzips the response body, unless it was already encoded or there is no body
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+// WriteHeader switches to gzip encoding for whole successful responses that are not already encoded or compressed
+// (ranges are never gzipped, as their Content-Range would not match the encoded body)
+func (gzw *gzipResponseWriter) WriteHeader(status int) {
+	if gzw.wroteHeader {
+		return
+	}
+	gzw.wroteHeader = true
+	header := gzw.Header()
+	if status == 200 && header.Get("Content-Encoding") == "" && compressible(header.Get("Content-Type")) {
+		if length := header.Get("Content-Length"); length != "" {
+			header.Set(LENGTH_HEADER, length)
+		}
+		header.Del("Content-Length")
+		header.Set("Content-Encoding", "gzip")
+		gzw.gz = gzip.NewWriter(gzw.ResponseWriter)
+	}
+	gzw.ResponseWriter.WriteHeader(status)
+}
+
+// Write writes the (gzipped if so decided) response body
+func (gzw *gzipResponseWriter) Write(p []byte) (int, error) {
+	if !gzw.wroteHeader {
+		gzw.WriteHeader(200)
+	}
+	if gzw.gz != nil {
+		return gzw.gz.Write(p)
+	}
+	return gzw.ResponseWriter.Write(p)
+}
+
+// compressible tells whether contents of contentType are worth gzipping
+func compressible(contentType string) bool {
+	for _, prefix := range compressedTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// Close ends the gzip stream, if any
+func (gzw *gzipResponseWriter) Close() error {
+	if gzw.gz != nil {
+		return gzw.gz.Close()
+	}
+	return nil
+}
+
+// wireBytes and logicalBytes count the bytes received by the client, as transferred and once decoded
+var wireBytes, logicalBytes int64
+
+// Transferred returns the bytes received by the client from slicesync servers so far,
+// both as transferred over the wire (maybe compressed) and once decoded (logical)
+func Transferred() (wire, logical int64) {
+	return atomic.LoadInt64(&wireBytes), atomic.LoadInt64(&logicalBytes)
+}
+
+// countingReader counts the bytes read into counter
+type countingReader struct {
+	r       io.Reader
+	counter *int64
+}
+
+// Read for countingReader's io.Reader implementation
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	atomic.AddInt64(cr.counter, int64(n))
+	return n, err
+}
+
+// decodedBody is a response body decoded (and counted) as it is read
+type decodedBody struct {
+	io.Reader
+	body io.Closer
+}
+
+// Close closes the response body
+func (db *decodedBody) Close() error {
+	return db.body.Close()
+}
+
+// acceptEncoding asks for compressed responses, decoded later with decode
+func acceptEncoding(req *http.Request) {
+	req.Header.Set("Accept-Encoding", "gzip")
+}
+
+// decode returns the response body decoding its Content-Encoding, counting the transferred bytes
+func decode(resp *http.Response) (io.ReadCloser, error) {
+	wire := &countingReader{resp.Body, &wireBytes}
+	switch resp.Header.Get("Content-Encoding") {
+	case "":
+		return &decodedBody{&countingReader{wire, &logicalBytes}, resp.Body}, nil
+	case "gzip":
+		gz, err := gzip.NewReader(wire)
+		if err != nil {
+			return nil, err
+		}
+		return &decodedBody{&countingReader{gz, &logicalBytes}, resp.Body}, nil
+	}
+	return nil, fmt.Errorf("Unsupported Content-Encoding %v!", resp.Header.Get("Content-Encoding"))
+}
+
+// decodedLength returns the length of the response body once decoded
+func decodedLength(resp *http.Response) (int64, error) {
+	if resp.Header.Get("Content-Encoding") == "" {
+		return strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	}
+	return strconv.ParseInt(resp.Header.Get(LENGTH_HEADER), 10, 64)
+}
@@ -29,6 +29,8 @@ type Diffs struct {
 	Slice, Size, Differences int64
 	Diffs                    []Diff
 	Hash, AlikeHash          string
+	Hashing                  string   `json:"-"` // Slice hashing of Hashes
+	Hashes                   []string `json:"-"` // Remote slice hashes, to verify each slice written (never sent)
 }
 
 // calcDiffsFunc returns the Diffs between remote filename and local alike or an error
@@ -39,7 +41,31 @@ var DefaultCalcDiffs = NaiveDiffs
 
 // NewDiffs creates a Diffs data type
 func NewDiffs(server, filename, alike string, slice, size int64) *Diffs {
-	return &Diffs{server, filename, alike, slice, size, 0, make([]Diff, 0, 10), "", ""}
+	return &Diffs{server, filename, alike, slice, size, 0, make([]Diff, 0, 10), "", "", "", nil}
+}
+
+// add appends diff to the Diffs, joining it with the last one when they are contiguous
+func (sd *Diffs) add(diff Diff) {
+	if n := len(sd.Diffs); n > 0 {
+		last := &sd.Diffs[n-1]
+		if last.Different == diff.Different && last.Offset+last.Size == diff.Offset {
+			last.Size += diff.Size
+			return
+		}
+	}
+	sd.Diffs = append(sd.Diffs, diff)
+}
+
+// positional tells whether the Diffs offsets match their positions in both the remote file and the local alike
+func (sd *Diffs) positional() bool {
+	pos := int64(0)
+	for _, diff := range sd.Diffs {
+		if diff.Offset != pos {
+			return false
+		}
+		pos += diff.Size
+	}
+	return true
 }
 
 // String shows the diffs in a json representation
@@ -82,15 +108,19 @@ func CalcDiffs(fileurl, alike string, slice int64) (*Diffs, error) {
 //    and register and join the different areas in Diffs.Diffs with start Offset and Size
 // 4. Read local and remote total file hashes
 // 5. Return the Diffs
+//
+// When the remote hash dump was cut in content defined chunks, ChunkDiffs is used instead
+// When the server advertises it, the Diffs are calculated by the server instead (see ServerDiffs),
+// unless remote hash dumps must be signed (see TrustedKey), falling back here only if the server can not do it
+// (any other server error, such as a denied access, is returned)
 func NaiveDiffs(server, filename, alike string, slice int64) (*Diffs, error) {
-	// local & remote streams opening
-	localHnd := &LocalHashNDump{"."}
-	lc, err := localHnd.Hash(alike)
-	if err != nil {
-		return nil, fmt.Errorf("Error opening local diff source: %v", err)
+	if TrustedKey == nil {
+		diffs, err := ServerDiffs(server, filename, alike, slice)
+		if _, unsupported := err.(*unsupportedError); !unsupported {
+			return diffs, err
+		}
 	}
-	defer lc.Close()
-	local := bufio.NewReader(lc)
+	// remote stream opening & header
 	remoteHnd := &RemoteHashNDump{server}
 	rm, err := remoteHnd.Hash(filename)
 	if err != nil {
@@ -98,18 +128,45 @@ func NaiveDiffs(server, filename, alike string, slice int64) (*Diffs, error) {
 	}
 	defer rm.Close()
 	remote := bufio.NewReader(rm)
-	// local & remote headers
-	lsize, err := readHeader(local, alike, slice)
+	header, err := readDumpHeader(remote, filename)
 	if err != nil {
-		return nil, fmt.Errorf("Local diff source header error: %v", err)
+		return nil, fmt.Errorf("Remote diff source header error: %v", err)
 	}
-	rsize, err := readHeader(remote, filename, slice)
+	if header.Chunking != nil {
+		return chunkDiffs(server, filename, alike, header, remote)
+	}
+	if header.Slice != slice {
+		return nil, fmt.Errorf("Remote diff source header error: Slice mismatch: Expecting %v but got %v!",
+			slice, header.Slice)
+	}
+	// local stream opening & header
+	localHnd := &LocalHashNDump{"."}
+	lc, err := localHnd.Hash(alike)
 	if err != nil {
-		return nil, fmt.Errorf("Remote diff source header error: %v", err)
+		return nil, fmt.Errorf("Error opening local diff source: %v", err)
 	}
+	defer lc.Close()
+	local := bufio.NewReader(lc)
+	return naiveDiffs(NewDiffs(server, filename, alike, slice, header.Length), local, remote, header)
+}
+
+// naiveDiffs builds the Diffs from the local alike hash stream, from its header on, against the remote hash stream,
+// past its already read header
+func naiveDiffs(diffs *Diffs, local, remote *bufio.Reader, header *dumpHeader) (*Diffs, error) {
+	slice := diffs.Slice
+	localHeader, err := readDumpHeader(local, diffs.Alike)
+	if err == nil && (localHeader.Slice != slice || localHeader.Hashing != header.Hashing ||
+		localHeader.Chunking != nil) {
+		err = fmt.Errorf("Slicing mismatch: Expecting %v %v slices but got %v %v!",
+			slice, header.Hashing, localHeader.Slice, localHeader.Hashing)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Local diff source header error: %v", err)
+	}
+	lsize := localHeader.Length
+	diffs.Hashing = header.Hashing
 	// diff building loop
-	diffs := NewDiffs(server, filename, alike, slice, rsize)
-	if err = diffsBuilder(diffs, local, remote, lsize); err != nil {
+	if err = diffsBuilder(diffs, local, remote, lsize, header); err != nil {
 		return nil, fmt.Errorf("DiffBuilder error: %v", err)
 	}
 	if diffs.Size > 0 && len(diffs.Diffs) == 0 {
@@ -129,53 +186,56 @@ func NaiveDiffs(server, filename, alike string, slice int64) (*Diffs, error) {
 }
 
 // diffsBuilder builds the diffs from the hash streams naively, just matching blocks on the same positions
-func diffsBuilder(diffs *Diffs, local, remote *bufio.Reader, lsize int64) error {
-	indiff := false
+// Different slices are narrowed down to their different sub-slices when the remote has sub-slice hashes
+func diffsBuilder(diffs *Diffs, local, remote *bufio.Reader, lsize int64, header *dumpHeader) error {
 	end := min(lsize, diffs.Size)
-	segment := diffs.Slice
-	start := int64(0)
+	narrower := newNarrower(diffs.Alike, header)
+	defer narrower.Close()
 	pos := int64(0)
-	for ; pos < end; pos += segment {
-		if pos+segment > end {
-			segment = end - pos
-		}
-		localHash, err := readString(local)
+	for ; pos < end; pos += diffs.Slice {
+		segment := min(diffs.Slice, end-pos)
+		localLine, err := readString(local)
 		if err != nil {
 			return err
 		}
-		remoteHash, err := readString(remote)
+		remoteLine, err := readString(remote)
 		if err != nil {
 			return err
 		}
-		if !indiff && localHash != remoteHash { // diff starts
-			if len(diffs.Diffs) == 0 && pos > 0 { // special Diffs array init case
-				diffs.Diffs = append(diffs.Diffs, Diff{start, 0, false})
-			}
-			if len(diffs.Diffs) > 0 { // only if there is a non-different segment before...
-				size := pos - start
-				diffs.Diffs[len(diffs.Diffs)-1].Size = size
+		localHash, _ := splitSubSlices(localLine)
+		remoteHash, subHashes := splitSubSlices(remoteLine)
+		diffs.Hashes = append(diffs.Hashes, remoteHash)
+		if localHash == remoteHash {
+			diffs.add(Diff{pos, segment, false})
+		} else if len(subHashes) > 0 {
+			sliceEnd := min(pos+diffs.Slice, diffs.Size)
+			if err := narrower.narrow(diffs, subHashes, pos, sliceEnd, end); err != nil {
+				return err
 			}
-			start = pos
-			diffs.Diffs = append(diffs.Diffs, Diff{start, 0, true})
+		} else {
+			diffs.add(Diff{pos, segment, true})
 			diffs.Differences += segment
-			indiff = true
-		} else if indiff && localHash == remoteHash { // diffs ends
-			size := pos - start
-			diffs.Diffs[len(diffs.Diffs)-1].Size = size
-			diffs.Differences += size
-			start = pos
-			diffs.Diffs = append(diffs.Diffs, Diff{start, 0, false})
-			indiff = false
 		}
 	}
+	for lpos := pos; lpos < lsize; lpos += diffs.Slice { // skip any remaining local slices
+		if _, err := readString(local); err != nil {
+			return err
+		}
+	}
+	for rpos := pos; rpos < diffs.Size; rpos += diffs.Slice { // keep just the hashes of remaining remote slices
+		remoteLine, err := readString(remote)
+		if err != nil {
+			return err
+		}
+		remoteHash, _ := splitSubSlices(remoteLine)
+		diffs.Hashes = append(diffs.Hashes, remoteHash)
+	}
 	if len(diffs.Diffs) == 0 {
-		diffs.Diffs = append(diffs.Diffs, Diff{0, pos, false})
-	} else {
-		diffs.Diffs[len(diffs.Diffs)-1].Size = pos - start
+		diffs.Diffs = append(diffs.Diffs, Diff{0, end, false})
 	}
 	if lsize < diffs.Size {
 		remaining := diffs.Size - lsize
-		diffs.Diffs = append(diffs.Diffs, Diff{lsize, remaining, true})
+		diffs.add(Diff{lsize, remaining, true})
 		diffs.Differences += remaining
 	}
 	return nil
@@ -193,7 +253,7 @@ func AdvancedDiffs(server, filename, alike string, slice int64) (*Diffs, error)
 	defer rm.Close()
 	remote := bufio.NewReader(rm)
 	fmt.Println("header")
-	rsize, err := readHeader(remote, filename, slice)
+	rsize, err := readHeader(remote, filename, slice, NewSliceHasher().Name())
 	if err != nil {
 		return nil, fmt.Errorf("Remote diff source header error: %v", err)
 	}
@@ -258,13 +318,13 @@ func slide(r *bufio.Reader, slice int) (oldb, newb byte, err error) {
 }
 
 // readHeader reads the full .slicesync file/stream header checking that all is correct and returning the file size
-func readHeader(r *bufio.Reader, filename string, slice int64) (size int64, err error) {
+func readHeader(r *bufio.Reader, filename string, slice int64, hashing string) (size int64, err error) {
 	attrs := []string{"Version", "Filename", "Slice", "Slice Hashing"}
 	expectedValues := []interface{}{
 		Version,
 		filepath.Base(filename),
 		fmt.Sprintf("%v", slice),
-		NewSliceHasher().Name(),
+		hashing,
 	}
 	for n, attr := range attrs {
 		val, err := readAttribute(r, attr)
@@ -275,9 +335,162 @@ func readHeader(r *bufio.Reader, filename string, slice int64) (size int64, err
 			return 0, fmt.Errorf("%s mismatch: Expecting %s but got %s!", attr, expectedValues[n], val)
 		}
 	}
+	if next, _ := r.Peek(len(KEY_ID + ":")); string(next) == KEY_ID+":" {
+		if _, err := readAttribute(r, KEY_ID); err != nil {
+			return 0, err
+		}
+	}
 	return readInt64Attribute(r, "Length")
 }
 
+// dumpHeader holds the information in a .slicesync file/stream header
+type dumpHeader struct {
+	Slice, Length int64
+	Hashing       string
+	Chunking      *CDC   // nil for fixed size slices
+	SubSlice      int64  // 0 when there are no sub-slice hashes
+	Offset        int64  // Only set on range hash dumps (see HashRange)
+	KeyId         string // Only set on signed hash dumps (see SigningKey)
+}
+
+// readDumpHeader reads the full .slicesync file/stream header whatever its slice size or chunking
+func readDumpHeader(r *bufio.Reader, filename string) (*dumpHeader, error) {
+	attrs := []string{"Version", "Filename"}
+	expectedValues := []string{Version, filepath.Base(filename)}
+	for n, attr := range attrs {
+		val, err := readAttribute(r, attr)
+		if err != nil {
+			return nil, err
+		}
+		if val != expectedValues[n] {
+			return nil, fmt.Errorf("%s mismatch: Expecting %s but got %s!", attr, expectedValues[n], val)
+		}
+	}
+	header := &dumpHeader{}
+	var err error
+	if header.Slice, err = readInt64Attribute(r, "Slice"); err != nil {
+		return nil, err
+	}
+	if header.Slice <= 0 {
+		return nil, fmt.Errorf("Invalid slice size %v!", header.Slice)
+	}
+	val, err := readAttribute(r, "Slice Hashing")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := newSliceHasher(val); err != nil {
+		return nil, err
+	}
+	header.Hashing = val
+	if next, _ := r.Peek(len(KEY_ID + ":")); string(next) == KEY_ID+":" {
+		if header.KeyId, err = readAttribute(r, KEY_ID); err != nil {
+			return nil, err
+		}
+	}
+	if next, _ := r.Peek(len("Chunking:")); string(next) == "Chunking:" {
+		val, err := readAttribute(r, "Chunking")
+		if err != nil {
+			return nil, err
+		}
+		if header.Chunking, err = parseCDC(val); err != nil {
+			return nil, err
+		}
+	}
+	if next, _ := r.Peek(len("Sub Slice:")); string(next) == "Sub Slice:" {
+		if header.SubSlice, err = readInt64Attribute(r, "Sub Slice"); err != nil {
+			return nil, err
+		}
+		if header.SubSlice <= 0 || header.SubSlice >= header.Slice {
+			return nil, fmt.Errorf("Invalid sub-slice size %v for slice %v!", header.SubSlice, header.Slice)
+		}
+	}
+	if next, _ := r.Peek(len("Offset:")); string(next) == "Offset:" {
+		if header.Offset, err = readInt64Attribute(r, "Offset"); err != nil {
+			return nil, err
+		}
+	}
+	if header.Length, err = readInt64Attribute(r, "Length"); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// ChunkDiffs returns the Diffs between the remote filename, hashed in content defined chunks, and local alike
+//
+// The local alike is cut in chunks the same way on the fly, and each remote chunk is taken from any position
+// of the local alike holding a chunk with the same hash, or downloaded otherwise
+// So, unlike Diffs from NaiveDiffs, the Offset of non-different Diffs refers to the local alike
+func ChunkDiffs(server, filename, alike string, slice int64) (*Diffs, error) {
+	remoteHnd := &RemoteHashNDump{server}
+	rm, err := remoteHnd.Hash(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening remote diff source: %v", err)
+	}
+	defer rm.Close()
+	remote := bufio.NewReader(rm)
+	header, err := readDumpHeader(remote, filename)
+	if err != nil {
+		return nil, fmt.Errorf("Remote diff source header error: %v", err)
+	}
+	if header.Chunking == nil {
+		return nil, fmt.Errorf("Remote diff source is not chunked!")
+	}
+	return chunkDiffs(server, filename, alike, header, remote)
+}
+
+// chunkDiffs builds the Diffs from the remote chunks stream, matching them against the local alike chunks
+func chunkDiffs(server, filename, alike string, header *dumpHeader, remote *bufio.Reader) (*Diffs, error) {
+	local, err := os.Open(alike)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening local alike: %v", err)
+	}
+	defer local.Close()
+	sliceHash, err := newSliceHasher(header.Hashing)
+	if err != nil {
+		return nil, err
+	}
+	h := NewHasher()
+	chunks := make(map[string]int64)
+	if err := header.Chunking.chunks(local, func(offset int64, data []byte) error {
+		h.Write(data)
+		key := fmt.Sprintf("%v %s", len(data), chunkHash(sliceHash, data))
+		if _, ok := chunks[key]; !ok {
+			chunks[key] = offset
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("Error chunking local alike: %v", err)
+	}
+	diffs := NewDiffs(server, filename, alike, header.Slice, header.Length)
+	diffs.AlikeHash = fmt.Sprintf("%x", h.Sum(nil))
+	for pos := int64(0); pos < header.Length; {
+		line, err := readString(remote)
+		if err != nil {
+			return nil, fmt.Errorf("DiffBuilder error: %v", err)
+		}
+		offset, size, hash, err := parseChunk(line)
+		if err != nil {
+			return nil, fmt.Errorf("DiffBuilder error: %v", err)
+		}
+		if offset != pos || size <= 0 {
+			return nil, fmt.Errorf("DiffBuilder error: Unexpected chunk %v at %v!", line, pos)
+		}
+		if loffset, ok := chunks[fmt.Sprintf("%v %s", size, hash)]; ok {
+			diffs.add(Diff{loffset, size, false})
+		} else {
+			diffs.add(Diff{offset, size, true})
+			diffs.Differences += size
+		}
+		pos += size
+	}
+	if header.Length > 0 {
+		if diffs.Hash, err = readAttribute(remote, NewHasher().Name()); err != nil {
+			return nil, fmt.Errorf("Remote file hash error: %v", err)
+		}
+	}
+	return diffs, nil
+}
+
 // readString returns the next string or an error
 func readString(r *bufio.Reader) (string, error) {
 	line, err := r.ReadString('\n')
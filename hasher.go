@@ -3,6 +3,8 @@ package slicesync
 import (
 	"crypto/md5"
 	"crypto/sha1"
+	"encoding"
+	"fmt"
 	"hash"
 )
 
@@ -23,6 +25,7 @@ type simpleHash struct {
 }
 
 // RollingHash can roll or scroll the hash window
+// (Roll may return the same internal slice on each call, so that rolling does not allocate)
 type RollingHash interface {
 	hash.Hash
 	Roll(window uint32, oldbyte, newbyte byte) []byte
@@ -40,6 +43,37 @@ func (sh *simpleHash) Name() string {
 	return sh.name
 }
 
+// MarshalBinary saves the internal hash state, so that hashing can be resumed later
+func (sh *simpleHash) MarshalBinary() ([]byte, error) {
+	m, ok := sh.Hash.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil, fmt.Errorf("%v hash state can not be saved!", sh.name)
+	}
+	return m.MarshalBinary()
+}
+
+// UnmarshalBinary restores an internal hash state saved by MarshalBinary
+func (sh *simpleHash) UnmarshalBinary(state []byte) error {
+	u, ok := sh.Hash.(encoding.BinaryUnmarshaler)
+	if !ok {
+		return fmt.Errorf("%v hash state can not be restored!", sh.name)
+	}
+	return u.UnmarshalBinary(state)
+}
+
+// saveHash returns h's internal state or nil if it can not be saved
+func saveHash(h NamedHash) []byte {
+	m, ok := h.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil
+	}
+	state, err := m.MarshalBinary()
+	if err != nil {
+		return nil
+	}
+	return state
+}
+
 // Complex hash implements hash.Hash composed of a 32bit rolling hash and strong Hash
 type complexHash struct {
 	rolling RollingHash32
@@ -97,8 +131,33 @@ func NewHasher() NamedHash {
 	return &simpleHash{sha1.New(), "sha1"}
 }
 
+// SliceHashings is the registry of slice hashing algorithms, by name
+var SliceHashings = map[string]func() NamedHash{
+	"adler32+md5": func() NamedHash {
+		return &complexHash{NewRollingAdler32(), md5.New(), "adler32+md5"}
+	},
+	"buzhash+md5": func() NamedHash {
+		return &complexHash{NewRollingBuzhash(), md5.New(), "buzhash+md5"}
+	},
+	"rabinkarp+md5": func() NamedHash {
+		return &complexHash{NewRollingRabinKarp(), md5.New(), "rabinkarp+md5"}
+	},
+}
+
+// SliceHashing is the name of the slice hashing algorithm used to produce hash dumps
+var SliceHashing = "adler32+md5"
+
 // newSliceHasher returns a Hash implementation for each slice 
 // (SHA1 on naive implementation or rolling+hash in rsync's symulation)
 func NewSliceHasher() NamedHash {
-	return &complexHash{NewRollingAdler32(), md5.New(), "adler32+md5"}
+	return SliceHashings[SliceHashing]()
+}
+
+// newSliceHasher returns the slice hashing algorithm registered as name
+func newSliceHasher(name string) (NamedHash, error) {
+	newHash, ok := SliceHashings[name]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported Slice Hashing %s!", name)
+	}
+	return newHash(), nil
 }
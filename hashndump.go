@@ -2,6 +2,7 @@ package slicesync
 
 import (
 	"bufio"
+	"crypto/ed25519"
 	"encoding/base64"
 	"fmt"
 	"io"
@@ -13,17 +14,24 @@ import (
 )
 
 const (
-	AUTOSIZE        = 0 // Use AUTOSIZE when you don't know or care for the total file or slice size 
-	MiB             = 1048576
-	Version         = "1"
-	SliceSyncExt    = ".slicesync"
-	SlicesyncDir    = SliceSyncExt
-	TmpSliceSyncExt = ".tmp" + SliceSyncExt
-	bufferSize      = 1024
-	nfiles          = 3
-	DEFAULT_PERIOD  = 1 * time.Second
+	AUTOSIZE          = 0 // Use AUTOSIZE when you don't know or care for the total file or slice size
+	MiB               = 1048576
+	Version           = "1"
+	SliceSyncExt      = ".slicesync"
+	SlicesyncDir      = SliceSyncExt
+	TmpSliceSyncExt   = ".tmp" + SliceSyncExt
+	StateSliceSyncExt = ".state" + SliceSyncExt
+	bufferSize        = 1024
+	nfiles            = 3
+	DEFAULT_PERIOD    = 1 * time.Second
+	DEFAULT_QUIET     = 5 * time.Second
+	STALE_TMP         = 10 * time.Minute // Untouched temporary hash dumps older than this are removed
 )
 
+// QuietPeriod is how long a file must remain unmodified before HashDir hashes it,
+// so that files still being copied or uploaded are not hashed halfway
+var QuietPeriod = DEFAULT_QUIET
+
 // LimitedReadCloser reads just N bytes from a reader and allows to close it as well
 type LimitedReadCloser struct {
 	io.LimitedReader
@@ -38,6 +46,7 @@ func (l *LimitedReadCloser) Close() error {
 type HashNDumper interface {
 	Hash(filename string) (io.ReadCloser, error)
 	Dump(filename string, offset, slice int64) (io.ReadCloser, int64, error)
+	HashRange(filename string, offset, size, slice int64) (io.ReadCloser, error)
 }
 
 // LocalHashNDump implements the HashNDump Service locally
@@ -46,28 +55,32 @@ type LocalHashNDump struct {
 }
 
 // HashService continually hashes the given directory with hash dumps of size slice and recursively (if asked to)
+// Blocking function, see HashingService for a service that can be controlled
 func HashService(dir string, slice int64, recursive bool, period time.Duration) {
-	for {
-		if err := HashDir(dir, slice, recursive); err != nil {
-			fmt.Fprint(os.Stderr, err.Error()+"\n")
-		}
-		time.Sleep(period)
-	}
+	service := NewHashingService(dir, slice, recursive, period)
+	service.Start()
+	service.wait()
 }
 
 // HashDir prepares the hashes of all files in the given directory, recursively if asked to
-// Blocking single threaded function (no go-routines), for quite a heavy background process
-// It returns any error it encounters in the process
+// Hidden files and symlinks are only hashed as allowed by the ServeHidden and Symlinks policies
+// Blocking function, files are hashed concurrently by up to HashWorkers go-routines,
+// recently requested files first (see Requested) and then smaller files before bigger ones
+// It returns the first error it encounters in the process
 func HashDir(dir string, slice int64, recursive bool) error {
 	//fmt.Println("HASDIR", dir, slice, recursive)
-	if e := os.MkdirAll(SlicesyncDir, 0750); e != nil {
+	if e := os.MkdirAll(slicesyncDir(dir, ""), 0750); e != nil {
 		return e
 	}
-	return hashDir(dir, "", slice, recursive)
+	q := &hashQueue{}
+	if err := hashDir(q, dir, "", slice, recursive); err != nil {
+		return err
+	}
+	return q.run(dir, slice, HashWorkers)
 }
 
-// hashDir performs HashDir recursive work
-func hashDir(basedir, reldir string, slice int64, recursive bool) error {
+// hashDir performs HashDir recursive work, cleaning up stale hash dumps and queueing files to be hashed on q
+func hashDir(q *hashQueue, basedir, reldir string, slice int64, recursive bool) error {
 	dir := filepath.Join(basedir, reldir)
 	//fmt.Println("hashDir", basedir, reldir, slice, recursive)
 	hdir := slicesyncDir(basedir, reldir)
@@ -75,6 +88,12 @@ func hashDir(basedir, reldir string, slice int64, recursive bool) error {
 		//fmt.Println("clean up in ", hdir, "against", dir)
 		if err := foreachFileInDir(hdir, func(fi os.FileInfo) error {
 			hfilename := filepath.Join(hdir, fi.Name())
+			if strings.HasSuffix(hfilename, TmpSliceSyncExt) {
+				if time.Since(fi.ModTime()) > STALE_TMP {
+					return os.Remove(hfilename)
+				}
+				return nil
+			}
 			filename := file4slicesync(hfilename)
 			//fmt.Println(hfilename, "->", filename, exists(filename))
 			if !exists(filename) {
@@ -89,14 +108,19 @@ func hashDir(basedir, reldir string, slice int64, recursive bool) error {
 		}
 	}
 	if err := foreachFileInDir(dir, func(fi os.FileInfo) error {
+		if q.isClosed() {
+			return errClosedQueue
+		}
 		filename := filepath.Join(reldir, fi.Name())
-		if needsHashing(fi, slice, dir, filename) {
+		fi, ok := hashable(basedir, filename, fi)
+		if !ok {
+			return nil
+		}
+		if needsHashing(fi, slice, basedir, filename) {
 			//fmt.Println("HASH ", filename)
-			if err := HashFile(basedir, filename, slice); err != nil {
-				return err
-			}
+			q.push(filename, fi.Size())
 		} else if recursive && fi.IsDir() && fi.Name() != SlicesyncDir {
-			if err := hashDir(basedir, filepath.Join(reldir, fi.Name()), slice, recursive); err != nil {
+			if err := hashDir(q, basedir, filepath.Join(reldir, fi.Name()), slice, recursive); err != nil {
 				return err
 			}
 		}
@@ -135,41 +159,90 @@ func foreachFileInDir(dir string, fn func(fi os.FileInfo) error) (e error) {
 // ** Filename: hashed
 // ** Slice: size of each sliced block
 // ** Slice Hashing: algorithm chosen for hashing
+// ** Key Id: of the signing key, only when signed (see SigningKey)
+// ** Chunking: parameters, only when cut in content defined chunks instead of fixed slices
+// ** Sub Slice: size, only when sub-slices are hashed as well
 // ** Length: of the file
 // * Then there are size / slice lines each with a slice hash for consecutive slices
+// (followed by its sub-slice hashes, if any)
+// (or, if chunked, a line with the offset, length and hash of each chunk)
 // * And finally there is the line {File Hashing name}+": "+total file hash 
+// * Optionally followed by the line "merkle-sha256: "+Merkle root over the slice hashes (see MerkleTree)
+// * And, when signed, the line "ed25519: "+signature of all the attribute lines above
 //
 // (File Hashing algorithm is usually different from )
-func HashFile(basedir, filename string, slice int64) (err error) {
+//
+// If the file changes while being hashed the hash dump is discarded and an error returned
+func HashFile(basedir, filename string, slice int64) error {
+	stable, err := hashFile(basedir, filename, slice)
+	if err == nil && !stable {
+		err = fmt.Errorf("File %v changed while being hashed, hash dump discarded!", filename)
+	}
+	return err
+}
+
+// hashFile performs HashFile's work, returning whether the file remained unchanged while being hashed
+// The hash dump is only produced if the file was stable and there were no errors
+func hashFile(basedir, filename string, slice int64) (stable bool, err error) {
+	defer func() {
+		if err != nil {
+			hashFailed()
+		}
+	}()
 	tmpFile := tmpSlicesyncFile(basedir, filename)
-	hashFile := SlicesyncFile(basedir, filename)
-	done := false
+	dumpFile := SlicesyncFile(basedir, filename)
 	if slice <= 0 { // protection against infinite loop by bad arguments
 		slice = MiB
 	}
 	mkdirs4File(tmpFile)
-	fhdump, err := os.OpenFile(tmpFile, os.O_CREATE|os.O_WRONLY, 0750)
+	file, err := os.Open(localFile(basedir, filename)) // For read access
 	if err != nil {
-		return err
+		return false, err
 	}
-	defer func() {
-		if done {
-			err = os.Rename(tmpFile, hashFile)
-		}
-	}()
-	defer fhdump.Close()
-	file, err := os.Open(filename) // For read access
+	fi, err := file.Stat()
 	if err != nil {
-		return err
+		file.Close()
+		return false, err
 	}
-	defer file.Close()
-	fi, err := file.Stat()
+	var prefix []string
+	h := NewHasher()
+	if IncrementalHashing && !ContentDefinedChunking && SubSlice == 0 {
+		prefix, h = readPrefix(basedir, filename, file, slice, fi.Size())
+	}
+	fhdump, err := os.OpenFile(tmpFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0750)
 	if err != nil {
-		return err
+		file.Close()
+		return false, err
 	}
-	hashDump(fhdump, file, filename, slice, fi.Size())
-	done = true
-	return
+	state, err := hashDump(fhdump, file, filename, slice, fi.Size(), prefix, h)
+	if e := fhdump.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		stable, err = unchanged(localFile(basedir, filename), fi)
+	}
+	if err == nil && stable && SigningKey != nil {
+		err = signDump(tmpFile, filename, SigningKey)
+	}
+	if err != nil || !stable {
+		os.Remove(tmpFile)
+		return
+	}
+	os.Remove(stateSlicesyncFile(basedir, filename)) // never pair the new dump with an old hash state
+	if err = os.Rename(tmpFile, dumpFile); err != nil {
+		return
+	}
+	hashed(fi.Size() - int64(len(prefix))*slice)
+	return true, writeHashState(basedir, filename, fi.Size()-fi.Size()%slice, state)
+}
+
+// unchanged returns true if filename still has the same size and modification time as fi
+func unchanged(filename string, fi os.FileInfo) (bool, error) {
+	now, err := os.Stat(filename)
+	if err != nil {
+		return false, err
+	}
+	return now.Size() == fi.Size() && now.ModTime().Equal(fi.ModTime()), nil
 }
 
 // Hash dumps a precalculated (by HashFile) file hash dump
@@ -182,7 +255,7 @@ func (hnd *LocalHashNDump) Hash(filename string) (rc io.ReadCloser, err error) {
 			err = r.(error)
 		}
 	}()
-	f, err := os.Lstat(filename)
+	f, err := os.Stat(calcpath(hnd.Dir, filename))
 	autopanic(err)
 	hfile := SlicesyncFile(hnd.Dir, filename)
 	if !isHashFileValid(f, hfile) {
@@ -202,7 +275,12 @@ func (hnd *LocalHashNDump) Hash(filename string) (rc io.ReadCloser, err error) {
 }
 
 // hashDump produces a Hash dump output into the given writer for the given slice and file size
-func hashDump(w io.Writer, file io.ReadCloser, filename string, slice, size int64) {
+// The first slice hashes may be given already calculated in prefix, with h holding the whole file hash
+// state up to the end of them and file positioned right there
+// It returns the whole file hash state at the last slice boundary, if h allows saving it
+// Read errors are both dumped in an "Error:" line and returned
+func hashDump(w io.Writer, file io.ReadCloser, filename string, slice, size int64,
+	prefix []string, h NamedHash) (state []byte, err error) {
 	defer file.Close()
 	bufW := bufio.NewWriterSize(w, bufferSize)
 	defer bufW.Flush()
@@ -211,13 +289,49 @@ func hashDump(w io.Writer, file io.ReadCloser, filename string, slice, size int6
 	fmt.Fprintf(bufW, "Filename: %v\n", filepath.Base(filename))
 	fmt.Fprintf(bufW, "Slice: %v\n", slice)
 	fmt.Fprintf(bufW, "Slice Hashing: %v\n", sliceHash.Name())
+	if SigningKey != nil {
+		fmt.Fprintf(bufW, "%v: %v\n", KEY_ID, KeyId(SigningKey.Public().(ed25519.PublicKey)))
+	}
+	if ContentDefinedChunking {
+		cdc := NewCDC(slice)
+		fmt.Fprintf(bufW, "Chunking: %v\n", cdc)
+		fmt.Fprintf(bufW, "Length: %v\n", size)
+		if err = cdc.dump(bufW, io.LimitReader(file, size), h, sliceHash); err != nil {
+			fmt.Fprintf(bufW, "Error:%s\n", err)
+			return nil, err
+		}
+		if size > 0 {
+			fmt.Fprintf(bufW, "%v: %x\n", h.Name(), h.Sum(nil))
+		}
+		return nil, bufW.Flush()
+	}
+	var subs *subSlicer
+	if SubSlice > 0 && SubSlice < slice {
+		subs = &subSlicer{hash: NewSliceHasher(), sub: SubSlice}
+		fmt.Fprintf(bufW, "Sub Slice: %v\n", SubSlice)
+	}
 	fmt.Fprintf(bufW, "Length: %v\n", size)
+	for _, hash := range prefix {
+		fmt.Fprintf(bufW, "%s\n", hash)
+	}
 	if size > 0 {
-		h := NewHasher()
+		boundary := size - size%slice
+		offset := int64(len(prefix)) * slice
+		if offset == boundary {
+			state = saveHash(h)
+		}
 		hashSink := io.MultiWriter(h, sliceHash)
+		if subs != nil {
+			hashSink = io.MultiWriter(h, sliceHash, subs)
+		}
+		var leaves [][]byte
+		if MerkleTree {
+			if leaves, err = merkleLeaves(prefix); err != nil {
+				return nil, err
+			}
+		}
 		readed := int64(0)
-		var err error
-		for pos := int64(0); pos < size; pos += readed {
+		for pos := offset; pos < size; pos += readed {
 			toread := slice
 			if toread > (size - pos) {
 				toread = size - pos
@@ -225,19 +339,35 @@ func hashDump(w io.Writer, file io.ReadCloser, filename string, slice, size int6
 			readed, err = io.CopyN(hashSink, file, toread)
 			if err != nil {
 				fmt.Fprintf(bufW, "Error:%s\n", err)
-				return
+				return nil, err
+			}
+			raw := sliceHash.Sum(nil)
+			if MerkleTree {
+				leaves = append(leaves, merkleLeaf(raw))
 			}
-			fmt.Fprintf(bufW, "%s\n", base64.StdEncoding.EncodeToString(sliceHash.Sum(nil)))
+			line := base64.StdEncoding.EncodeToString(raw)
+			if subs != nil {
+				line = strings.Join(append([]string{line}, subs.take()...), " ")
+			}
+			fmt.Fprintf(bufW, "%s\n", line)
 			sliceHash.Reset()
 			bufW.Flush()
+			if pos+readed == boundary {
+				state = saveHash(h)
+			}
 		}
 		fmt.Fprintf(bufW, "%v: %x\n", h.Name(), h.Sum(nil))
+		if MerkleTree {
+			fmt.Fprintf(bufW, "%v: %x\n", MERKLE, merkleRoot(leaves))
+		}
 	}
+	return state, bufW.Flush()
 }
 
 // needHashing returns true ONLY if there isn't a hash for filename at basedir
+// and the file has not been modified for QuietPeriod
 func needsHashing(f os.FileInfo, slice int64, basedir, filename string) bool {
-	if !f.IsDir() && f.Size() > slice {
+	if !f.IsDir() && f.Size() > slice && time.Since(f.ModTime()) >= QuietPeriod {
 		return !isHashFileValid(f, SlicesyncFile(basedir, filename))
 	}
 	return false
@@ -277,10 +407,9 @@ func (hnd *LocalHashNDump) Dump(filename string, offset, slice int64) (
 func calcpath(dir, filename string) string {
 	fullpath, err := filepath.Abs(filepath.Join(dir, filename))
 	autopanic(err)
-	fullpath = filepath.Clean(fullpath)
 	fulldir, err := filepath.Abs(dir)
 	autopanic(err)
-	if !filepath.HasPrefix(fullpath, fulldir) {
+	if !contained(fulldir, fullpath) {
 		panic(fmt.Errorf("Illegal filename %s, not within %s!", filename, fulldir))
 	}
 	return fullpath
@@ -312,6 +441,14 @@ func sliceFile(file *os.File, max, offset, slice int64) int64 {
 	return toread
 }
 
+// localFile returns the path of filename at basedir (absolute filenames are kept as they are)
+func localFile(basedir, filename string) string {
+	if filepath.IsAbs(filename) {
+		return filename
+	}
+	return filepath.Join(basedir, filename)
+}
+
 // tmpSlicesyncFile returns the corresponding temporary .tmp.slicesync file for filename
 func tmpSlicesyncFile(basedir, filename string) string {
 	return filepath.Join(slicesyncDir(basedir, filepath.Dir(filename)), filepath.Base(filename)+TmpSliceSyncExt)
@@ -329,7 +466,11 @@ func slicesyncDir(basedir, dir string) string {
 
 // file4slicesync returns the file or directory that corresponds to this slicesync file
 func file4slicesync(filename string) string {
-	return strings.Replace(strings.Replace(filename, SlicesyncDir+"/", "", -1), SliceSyncExt, "", 1)
+	filename = strings.Replace(filename, SlicesyncDir+"/", "", -1)
+	if strings.HasSuffix(filename, StateSliceSyncExt) {
+		return strings.TrimSuffix(filename, StateSliceSyncExt)
+	}
+	return strings.Replace(filename, SliceSyncExt, "", 1)
 }
 
 // mkdirs4File ensures filename's dir is make if it needs to be
@@ -0,0 +1,224 @@
+package slicesync
+
+import (
+	"container/heap"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	RECENT_REQUEST = 1 * time.Minute // How long a client request keeps boosting a file's hashing priority
+	MAX_REQUESTS   = 1024            // Most requested files remembered at once, the oldest are forgotten first
+)
+
+// HashWorkers is the number of concurrent hashing workers HashDir uses
+var HashWorkers = runtime.NumCPU()
+
+// requests remembers when files were last requested by a client
+var requests = struct {
+	sync.Mutex
+	at map[string]time.Time
+}{at: make(map[string]time.Time)}
+
+// Requested marks filename (relative to the served directory) as just requested by a client,
+// so that its pending hash dump, if any, is prepared before others
+// Only the latest MAX_REQUESTS files requested within RECENT_REQUEST are remembered
+func Requested(filename string) {
+	requests.Lock()
+	defer requests.Unlock()
+	filename = filepath.Clean(filename)
+	if _, ok := requests.at[filename]; !ok && len(requests.at) >= MAX_REQUESTS {
+		forgetRequests()
+	}
+	requests.at[filename] = time.Now()
+}
+
+// forgetRequests forgets the requests older than RECENT_REQUEST or, if there are none, the oldest one
+// (requests must be locked)
+func forgetRequests() {
+	oldest, oldestAt := "", time.Now()
+	for filename, at := range requests.at {
+		if time.Since(at) > RECENT_REQUEST {
+			delete(requests.at, filename)
+		} else if at.Before(oldestAt) {
+			oldest, oldestAt = filename, at
+		}
+	}
+	if len(requests.at) >= MAX_REQUESTS {
+		delete(requests.at, oldest)
+	}
+}
+
+// recentRequests returns the files requested within RECENT_REQUEST, the most recent first
+func recentRequests() []string {
+	requests.Lock()
+	defer requests.Unlock()
+	recent := make([]string, 0, len(requests.at))
+	for filename, at := range requests.at {
+		if time.Since(at) > RECENT_REQUEST {
+			delete(requests.at, filename)
+		} else {
+			recent = append(recent, filename)
+		}
+	}
+	sort.Slice(recent, func(i, j int) bool { return requests.at[recent[i]].After(requests.at[recent[j]]) })
+	return recent
+}
+
+// hashJob is a file pending to be hashed
+type hashJob struct {
+	filename string
+	size     int64
+}
+
+// jobHeap is a container/heap of hashJobs, smallest first, that knows where each file is
+type jobHeap struct {
+	jobs  []hashJob
+	index map[string]int // filename -> position in jobs
+}
+
+// Len for jobHeap's heap.Interface implementation
+func (h *jobHeap) Len() int { return len(h.jobs) }
+
+// Less for jobHeap's heap.Interface implementation
+func (h *jobHeap) Less(i, j int) bool { return h.jobs[i].size < h.jobs[j].size }
+
+// Swap for jobHeap's heap.Interface implementation
+func (h *jobHeap) Swap(i, j int) {
+	h.jobs[i], h.jobs[j] = h.jobs[j], h.jobs[i]
+	h.index[h.jobs[i].filename], h.index[h.jobs[j].filename] = i, j
+}
+
+// Push for jobHeap's heap.Interface implementation
+func (h *jobHeap) Push(x interface{}) {
+	job := x.(hashJob)
+	if h.index == nil {
+		h.index = make(map[string]int)
+	}
+	h.index[job.filename] = len(h.jobs)
+	h.jobs = append(h.jobs, job)
+}
+
+// Pop for jobHeap's heap.Interface implementation
+func (h *jobHeap) Pop() interface{} {
+	job := h.jobs[len(h.jobs)-1]
+	h.jobs = h.jobs[:len(h.jobs)-1]
+	delete(h.index, job.filename)
+	return job
+}
+
+// hashQueue holds the pending hashJobs and hands them out to the workers by priority
+type hashQueue struct {
+	sync.Mutex
+	jobs          jobHeap
+	closed        bool                             // No more jobs are taken once closed
+	onError       func(filename string, err error) // When set, errors are reported here and hashing goes on
+	hashed, bytes int64                            // Files hashed by run and their size
+}
+
+// errClosedQueue stops hashDir from walking any further once its queue is closed
+var errClosedQueue = fmt.Errorf("Hash queue closed!")
+
+// push adds a new hashJob for filename of the given size, unless it is already queued
+func (q *hashQueue) push(filename string, size int64) {
+	q.Lock()
+	defer q.Unlock()
+	if _, ok := q.jobs.index[filename]; ok || q.closed {
+		return
+	}
+	heap.Push(&q.jobs, hashJob{filename, size})
+	queued(1)
+}
+
+// pop removes and returns the next job to hash:
+// The most recently requested goes first, otherwise the smallest one
+func (q *hashQueue) pop() (hashJob, bool) {
+	recent := recentRequests() // before locking the queue, never while
+	q.Lock()
+	defer q.Unlock()
+	if q.jobs.Len() == 0 {
+		return hashJob{}, false
+	}
+	queued(-1)
+	for _, filename := range recent {
+		if i, ok := q.jobs.index[filename]; ok {
+			return heap.Remove(&q.jobs, i).(hashJob), true
+		}
+	}
+	return heap.Pop(&q.jobs).(hashJob), true
+}
+
+// len returns the number of pending jobs
+func (q *hashQueue) len() int {
+	q.Lock()
+	defer q.Unlock()
+	return q.jobs.Len()
+}
+
+// clear drops all pending jobs
+func (q *hashQueue) clear() {
+	q.Lock()
+	defer q.Unlock()
+	queued(-q.jobs.Len())
+	q.jobs = jobHeap{}
+}
+
+// close drops all pending jobs and ignores any pushed later, so only the jobs already taken are finished
+func (q *hashQueue) close() {
+	q.Lock()
+	defer q.Unlock()
+	queued(-q.jobs.Len())
+	q.jobs, q.closed = jobHeap{}, true
+}
+
+// isClosed tells whether the queue was closed
+func (q *hashQueue) isClosed() bool {
+	q.Lock()
+	defer q.Unlock()
+	return q.closed
+}
+
+// run hashes all queued jobs at basedir with up to workers concurrent go-routines
+// Files that change while being hashed are left for a later pass
+// It stops handing out jobs on the first error and returns it, unless errors are reported to onError
+func (q *hashQueue) run(basedir string, slice int64, workers int) error {
+	if workers < 1 {
+		workers = 1
+	}
+	start, hashedBefore := time.Now(), atomic.LoadInt64(&metrics.bytesHashed)
+	defer func() { hashingSpeed(atomic.LoadInt64(&metrics.bytesHashed)-hashedBefore, time.Since(start)) }()
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job, ok := q.pop(); ok; job, ok = q.pop() {
+				stable, err := hashFile(basedir, job.filename, slice)
+				if err != nil && q.onError != nil {
+					q.onError(job.filename, err)
+					continue
+				}
+				if err != nil {
+					q.clear()
+					errs <- err
+					return
+				}
+				if stable {
+					atomic.AddInt64(&q.hashed, 1)
+					atomic.AddInt64(&q.bytes, job.size)
+				}
+			}
+			errs <- nil
+		}()
+	}
+	var err error
+	for i := 0; i < workers; i++ {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,114 @@
+package slicesync
+
+import (
+	"bufio"
+	"encoding"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// IncrementalHashing allows HashFile to only hash the new tail of files that grew since their last hash dump
+// (such as logs or journals), reusing the previous slice hashes and resuming the whole file hash
+//
+// The previous dump is only reused if all its complete slices still match the file, so the whole file
+// is still read, but rewritten files are never reused (they are just hashed again)
+// (content defined chunks or sub-slice hashes are always hashed from scratch)
+var IncrementalHashing = false
+
+// stateSlicesyncFile returns the .state.slicesync file keeping the resumable whole file hash state for filename
+func stateSlicesyncFile(basedir, filename string) string {
+	return filepath.Join(slicesyncDir(basedir, filepath.Dir(filename)), filepath.Base(filename)+StateSliceSyncExt)
+}
+
+// readPrefix returns the slice hashes of the previous hash dump of filename that are still valid for
+// the file of the given size, and the whole file hash resumed at the end of them
+// file is left positioned right after those slices
+// If there is no valid prefix, no slice hashes and a fresh whole file hash are returned
+func readPrefix(basedir, filename string, file *os.File, slice, size int64) ([]string, NamedHash) {
+	h := NewHasher()
+	offset, state, err := readHashState(basedir, filename, h.Name())
+	if err != nil || offset <= 0 || offset%slice != 0 || offset > size {
+		return nil, h
+	}
+	hashes, err := readDumpPrefix(SlicesyncFile(basedir, filename), filename, slice, offset, size)
+	if err != nil || !prefixMatches(file, hashes, slice) {
+		return nil, h
+	}
+	if u, ok := h.(encoding.BinaryUnmarshaler); !ok || u.UnmarshalBinary(state) != nil {
+		return nil, NewHasher()
+	}
+	if _, err := file.Seek(offset, os.SEEK_SET); err != nil {
+		return nil, NewHasher()
+	}
+	return hashes, h
+}
+
+// readDumpPrefix reads the slice hashes up to offset from the hash dump hfilename,
+// as long as it is the dump the hash state at offset was saved with and the file did not shrink
+func readDumpPrefix(hfilename, filename string, slice, offset, size int64) ([]string, error) {
+	f, err := os.Open(hfilename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	length, err := readHeader(r, filename, slice, NewSliceHasher().Name())
+	if err != nil {
+		return nil, err
+	}
+	if length > size || length-length%slice != offset {
+		return nil, fmt.Errorf("Hash dump %v does not match the saved hash state!", hfilename)
+	}
+	hashes := make([]string, offset/slice)
+	for i := range hashes {
+		if hashes[i], err = readString(r); err != nil {
+			return nil, err
+		}
+	}
+	return hashes, nil
+}
+
+// prefixMatches checks that all the given slice hashes still match the file contents
+func prefixMatches(file *os.File, hashes []string, slice int64) bool {
+	for i := range hashes {
+		sliceHash := NewSliceHasher()
+		n, err := io.Copy(sliceHash, io.NewSectionReader(file, int64(i)*slice, slice))
+		if err != nil || n != slice || base64.StdEncoding.EncodeToString(sliceHash.Sum(nil)) != hashes[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// readHashState reads the saved whole file hash state of filename and the offset it was saved at
+func readHashState(basedir, filename, hname string) (offset int64, state []byte, err error) {
+	f, err := os.Open(stateSlicesyncFile(basedir, filename))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	if offset, err = readInt64Attribute(r, "Offset"); err != nil {
+		return 0, nil, err
+	}
+	encoded, err := readAttribute(r, hname)
+	if err != nil {
+		return 0, nil, err
+	}
+	state, err = base64.StdEncoding.DecodeString(encoded)
+	return offset, state, err
+}
+
+// writeHashState saves the whole file hash state of filename at offset, if IncrementalHashing is enabled
+func writeHashState(basedir, filename string, offset int64, state []byte) error {
+	if !IncrementalHashing || state == nil {
+		return nil
+	}
+	content := fmt.Sprintf("Offset: %v\n%v: %s\n",
+		offset, NewHasher().Name(), base64.StdEncoding.EncodeToString(state))
+	return ioutil.WriteFile(stateSlicesyncFile(basedir, filename), ([]byte)(content), 0750)
+}
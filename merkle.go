@@ -0,0 +1,337 @@
+package slicesync
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	MERKLE = "merkle-sha256" // Merkle root trailer attribute name in the .slicesync hash dumps
+)
+
+// MerkleTree makes HashFile end the hash dumps of fixed size slices with the root of a Merkle tree
+// over the slice hashes, so that single slices can be verified with a proof path from the server
+//
+// The tree follows RFC 6962 with SHA-256: leaves are hashed as 0x00 + slice hash and nodes as 0x01 + left + right
+var MerkleTree = false
+
+// merkleLeaf returns the Merkle tree leaf hash for a raw slice hash
+func merkleLeaf(sliceHash []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(sliceHash)
+	return h.Sum(nil)
+}
+
+// merkleNode returns the Merkle tree node hash for the left and right children hashes
+func merkleNode(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// merkleSplit returns the largest power of 2 smaller than n (n > 1)
+func merkleSplit(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// merkleRoot returns the Merkle tree root of the given leaves
+func merkleRoot(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		h := sha256.Sum256(nil)
+		return h[:]
+	case 1:
+		return leaves[0]
+	}
+	k := merkleSplit(len(leaves))
+	return merkleNode(merkleRoot(leaves[:k]), merkleRoot(leaves[k:]))
+}
+
+// merklePath returns the proof (audit) path of the leaf at index m, from the bottom up
+func merklePath(leaves [][]byte, m int) [][]byte {
+	if len(leaves) <= 1 {
+		return nil
+	}
+	k := merkleSplit(len(leaves))
+	if m < k {
+		return append(merklePath(leaves[:k], m), merkleRoot(leaves[k:]))
+	}
+	return append(merklePath(leaves[k:], m-k), merkleRoot(leaves[:k]))
+}
+
+// merklePathRoot returns the Merkle root resulting from the leaf at index m of n leaves and its proof path
+func merklePathRoot(leaf []byte, m, n int64, path [][]byte) ([]byte, error) {
+	if m < 0 || m >= n {
+		return nil, fmt.Errorf("Invalid leaf %v of %v!", m, n)
+	}
+	fn, sn, r := m, n-1, leaf
+	for _, p := range path {
+		if sn == 0 {
+			return nil, fmt.Errorf("Proof path too long!")
+		}
+		if fn&1 == 1 || fn == sn {
+			r = merkleNode(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = merkleNode(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 {
+		return nil, fmt.Errorf("Proof path too short!")
+	}
+	return r, nil
+}
+
+// merkleLeaves returns the Merkle tree leaves for the base64 slice hashes
+func merkleLeaves(hashes []string) ([][]byte, error) {
+	leaves := make([][]byte, len(hashes))
+	for i, hash := range hashes {
+		raw, err := base64.StdEncoding.DecodeString(hash)
+		if err != nil {
+			return nil, err
+		}
+		leaves[i] = merkleLeaf(raw)
+	}
+	return leaves, nil
+}
+
+// checkMerkle checks that the slice hashes of the hash dump for filename match its Merkle root, if it has one
+func checkMerkle(dump []byte, filename string) error {
+	if !bytes.Contains(dump, []byte("\n"+MERKLE+":")) {
+		return nil
+	}
+	sd, err := readSliceDump(bufio.NewReader(bytes.NewReader(dump)), filename)
+	if err != nil {
+		return err
+	}
+	leaves, err := merkleLeaves(sd.Hashes)
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(merkleRoot(leaves)) != sd.Merkle {
+		return fmt.Errorf("Hash dump for %v does not match its Merkle root!", filename)
+	}
+	return nil
+}
+
+// MerkleProof proves that a slice hash belongs to a Merkle root
+type MerkleProof struct {
+	Slice, Length, Index, Leaves int64
+	Hashing, SliceHash           string
+	Root                         string
+	Path                         [][]byte
+}
+
+// Verify checks that data is the slice of the proof and that it belongs to the trusted Merkle root (hex)
+func (p *MerkleProof) Verify(data []byte, root string) error {
+	sliceHash, err := newSliceHasher(p.Hashing)
+	if err != nil {
+		return err
+	}
+	if chunkHash(sliceHash, data) != p.SliceHash {
+		return fmt.Errorf("Slice %v does not match its slice hash!", p.Index)
+	}
+	raw, err := base64.StdEncoding.DecodeString(p.SliceHash)
+	if err != nil {
+		return err
+	}
+	computed, err := merklePathRoot(merkleLeaf(raw), p.Index, p.Leaves, p.Path)
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(computed) != root {
+		return fmt.Errorf("Slice %v does not belong to Merkle root %v!", p.Index, root)
+	}
+	return nil
+}
+
+// writeProof writes the proof in its text format
+func writeProof(w io.Writer, filename string, p *MerkleProof) error {
+	bufW := bufio.NewWriter(w)
+	fmt.Fprintf(bufW, "Version: %v\n", Version)
+	fmt.Fprintf(bufW, "Filename: %v\n", filename)
+	fmt.Fprintf(bufW, "Slice: %v\n", p.Slice)
+	fmt.Fprintf(bufW, "Slice Hashing: %v\n", p.Hashing)
+	fmt.Fprintf(bufW, "Length: %v\n", p.Length)
+	fmt.Fprintf(bufW, "Index: %v\n", p.Index)
+	fmt.Fprintf(bufW, "Leaves: %v\n", p.Leaves)
+	fmt.Fprintf(bufW, "Slice Hash: %v\n", p.SliceHash)
+	fmt.Fprintf(bufW, "%v: %v\n", MERKLE, p.Root)
+	for _, node := range p.Path {
+		fmt.Fprintf(bufW, "%x\n", node)
+	}
+	return bufW.Flush()
+}
+
+// readProof reads a proof in its text format
+func readProof(r *bufio.Reader, filename string) (*MerkleProof, error) {
+	header, err := readDumpHeader(r, filename)
+	if err != nil {
+		return nil, err
+	}
+	p := &MerkleProof{Slice: header.Slice, Length: header.Length, Hashing: header.Hashing}
+	if p.Index, err = readInt64Attribute(r, "Index"); err != nil {
+		return nil, err
+	}
+	if p.Leaves, err = readInt64Attribute(r, "Leaves"); err != nil {
+		return nil, err
+	}
+	if p.SliceHash, err = readAttribute(r, "Slice Hash"); err != nil {
+		return nil, err
+	}
+	if p.Root, err = readAttribute(r, MERKLE); err != nil {
+		return nil, err
+	}
+	for {
+		line, err := readString(r)
+		if err == io.EOF {
+			return p, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		node, err := hex.DecodeString(line)
+		if err != nil {
+			return nil, err
+		}
+		p.Path = append(p.Path, node)
+	}
+}
+
+// Proof returns the Merkle proof for the slice at index of filename, from its hash dump
+func (hnd *LocalHashNDump) Proof(filename string, index int64) (*MerkleProof, error) {
+	rc, err := hnd.Hash(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	dump, err := readSliceDump(bufio.NewReader(rc), filename)
+	if err != nil {
+		return nil, err
+	}
+	if dump.Merkle == "" {
+		return nil, fmt.Errorf("Hash dump for %v has no Merkle root!", filename)
+	}
+	if index < 0 || index >= int64(len(dump.Hashes)) {
+		return nil, fmt.Errorf("Invalid slice %v of %v!", index, len(dump.Hashes))
+	}
+	leaves, err := merkleLeaves(dump.Hashes)
+	if err != nil {
+		return nil, err
+	}
+	if hex.EncodeToString(merkleRoot(leaves)) != dump.Merkle {
+		return nil, fmt.Errorf("Hash dump for %v does not match its Merkle root!", filename)
+	}
+	return &MerkleProof{dump.Slice, dump.Length, index, int64(len(leaves)), dump.Hashing, dump.Hashes[index],
+		dump.Merkle, merklePath(leaves, int(index))}, nil
+}
+
+// serveProof serves the Merkle proof of the requested file slice given by the index query parameter
+func serveProof(dir string, w http.ResponseWriter, r *http.Request) {
+	index, err := strconv.ParseInt(r.URL.Query().Get("index"), 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid index: %v", err), http.StatusBadRequest)
+		return
+	}
+	hnd := &LocalHashNDump{dir}
+	proof, err := hnd.Proof(r.URL.Path, index)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	buf := &bytes.Buffer{}
+	writeProof(buf, filepath.Base(r.URL.Path), proof)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+// Proof returns the Merkle proof for the slice at index of the remote filename
+// (only servers supporting the "proof" slicesync extension can do it, such as syncserver)
+func (rhnd *RemoteHashNDump) Proof(filename string, index int64) (*MerkleProof, error) {
+	if !supports(rhnd.Server, PROOF) {
+		return nil, fmt.Errorf("Remote server %v does not serve Merkle proofs!", rhnd.Server)
+	}
+	query := url.Values{}
+	query.Set(SLICESYNC_PARAM, PROOF)
+	query.Set("index", fmt.Sprintf("%v", index))
+	rc, _, err := get(calcUrl(rhnd.Server, filename)+"?"+query.Encode(), 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return readProof(bufio.NewReader(rc), filename)
+}
+
+// serveRoot serves the hash dump of the requested file without its slice hashes,
+// so that its signed Merkle root can be fetched alone (see RemoteHashNDump.Root)
+func serveRoot(dir string, w http.ResponseWriter, r *http.Request) {
+	hnd := &LocalHashNDump{dir}
+	rc, err := hnd.Hash(r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer rc.Close()
+	dump, err := ioutil.ReadAll(rc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(dumpSummary(dump))
+}
+
+// Root returns the Merkle root (hex) of the remote filename without fetching its slice hashes,
+// once its signature is verified if there is a TrustedKey, so that single slices can be verified
+// with just their proofs (see MerkleProof.Verify)
+// (only servers supporting the "root" slicesync extension can do it, such as syncserver)
+func (rhnd *RemoteHashNDump) Root(filename string) (string, error) {
+	if !supports(rhnd.Server, ROOT) {
+		return "", fmt.Errorf("Remote server %v does not serve Merkle roots!", rhnd.Server)
+	}
+	query := url.Values{}
+	query.Set(SLICESYNC_PARAM, ROOT)
+	rc, _, err := get(calcUrl(rhnd.Server, filename)+"?"+query.Encode(), 0, 0)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	summary, err := ioutil.ReadAll(io.LimitReader(rc, MAX_UPLOADED_DUMP))
+	if err != nil {
+		return "", err
+	}
+	if TrustedKey != nil {
+		if err := verifyDump(summary, filename, TrustedKey); err != nil {
+			return "", err
+		}
+	}
+	for _, line := range strings.Split(string(summary), "\n") {
+		if strings.HasPrefix(line, MERKLE+":") {
+			return strings.TrimSpace(line[len(MERKLE)+1:]), nil
+		}
+	}
+	return "", fmt.Errorf("Hash dump for %v has no Merkle root!", filename)
+}
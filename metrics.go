@@ -0,0 +1,113 @@
+package slicesync
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MetricsPath is where servers expose their metrics in Prometheus text format, to those authorized by Access if any,
+// not exposed if empty (the admin API exposes them as well, see AdminHandler)
+var MetricsPath = "/metrics"
+
+// metrics of the hashing and the serving, all of them counters but for the gauges
+var metrics = struct {
+	filesHashed, hashErrors, bytesHashed int64
+	queueLength                          int64  // gauge
+	bytesPerSecond                       uint64 // gauge, float64 bits
+	rangeRequests, bytesServed           int64
+	requests                             sync.Map // request kind -> *int64
+}{}
+
+// hashed counts a file hashed with size bytes actually read
+func hashed(size int64) {
+	atomic.AddInt64(&metrics.filesHashed, 1)
+	atomic.AddInt64(&metrics.bytesHashed, size)
+}
+
+// hashFailed counts a file hash error
+func hashFailed() {
+	atomic.AddInt64(&metrics.hashErrors, 1)
+}
+
+// queued adds n (maybe negative) to the length of the hashing queues
+func queued(n int) {
+	atomic.AddInt64(&metrics.queueLength, int64(n))
+}
+
+// hashingSpeed records the bytes per second hashed on the last hashing pass
+func hashingSpeed(bytes int64, elapsed time.Duration) {
+	if bytes > 0 && elapsed > 0 {
+		atomic.StoreUint64(&metrics.bytesPerSecond, math.Float64bits(float64(bytes)/elapsed.Seconds()))
+	}
+}
+
+// served counts a request of the given kind, whether it asked for a range and the bytes sent
+func served(kind string, ranged bool, bytes int64) {
+	counter, _ := metrics.requests.LoadOrStore(kind, new(int64))
+	atomic.AddInt64(counter.(*int64), 1)
+	if ranged {
+		atomic.AddInt64(&metrics.rangeRequests, 1)
+	}
+	atomic.AddInt64(&metrics.bytesServed, bytes)
+}
+
+// requestKind returns what is requested: a "dump", a slicesync extension, the "metrics",
+// the "admin" API or a plain "file"
+func requestKind(r *http.Request, prefix string) string {
+	if prefix == ADMIN_PATH {
+		return "admin"
+	}
+	if MetricsPath != "" && r.URL.Path == MetricsPath {
+		return "metrics"
+	}
+	switch extension := r.URL.Query().Get(SLICESYNC_PARAM); extension {
+	case HASHES, DIFFS, BUNDLE, PROOF, ROOT:
+		return extension
+	}
+	if strings.HasPrefix(strings.TrimPrefix(r.URL.Path, prefix), SlicesyncDir+"/") {
+		return "dump"
+	}
+	return "file"
+}
+
+// writeMetric writes a metric in Prometheus text format
+func writeMetric(w http.ResponseWriter, name, kind, help string, value interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+}
+
+// serveMetrics serves all the metrics in Prometheus text format
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetric(w, "slicesync_files_hashed_total", "counter", "Files hashed into hash dumps.",
+		atomic.LoadInt64(&metrics.filesHashed))
+	writeMetric(w, "slicesync_hash_errors_total", "counter", "Files that failed to be hashed.",
+		atomic.LoadInt64(&metrics.hashErrors))
+	writeMetric(w, "slicesync_hashed_bytes_total", "counter", "Bytes read to hash files.",
+		atomic.LoadInt64(&metrics.bytesHashed))
+	writeMetric(w, "slicesync_hash_queue_length", "gauge", "Files waiting to be hashed.",
+		atomic.LoadInt64(&metrics.queueLength))
+	writeMetric(w, "slicesync_hash_bytes_per_second", "gauge", "Bytes hashed per second on the last hashing pass.",
+		math.Float64frombits(atomic.LoadUint64(&metrics.bytesPerSecond)))
+	writeMetric(w, "slicesync_range_requests_total", "counter", "Requests for a range of a file.",
+		atomic.LoadInt64(&metrics.rangeRequests))
+	writeMetric(w, "slicesync_served_bytes_total", "counter", "Bytes sent in response bodies.",
+		atomic.LoadInt64(&metrics.bytesServed))
+	fmt.Fprintf(w, "# HELP slicesync_requests_total Requests by kind: file, dump, slicesync extension, metrics or admin.\n")
+	fmt.Fprintf(w, "# TYPE slicesync_requests_total counter\n")
+	kinds := []string{}
+	metrics.requests.Range(func(kind, _ interface{}) bool {
+		kinds = append(kinds, kind.(string))
+		return true
+	})
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		counter, _ := metrics.requests.Load(kind)
+		fmt.Fprintf(w, "slicesync_requests_total{kind=%q} %v\n", kind, atomic.LoadInt64(counter.(*int64)))
+	}
+}
@@ -0,0 +1,127 @@
+package slicesync
+
+import (
+	"encoding/base64"
+	"io"
+	"os"
+	"strings"
+)
+
+// SubSlice is the size of the finer sub-slices also hashed within each slice of a hash dump (0 for none),
+// so that clients can narrow down a different slice to its different sub-slices before downloading it
+var SubSlice int64 = 0
+
+// subSlicer hashes whatever is written to it in consecutive sub-slices
+type subSlicer struct {
+	hash    NamedHash
+	sub     int64
+	written int64
+	hashes  []string
+}
+
+// Write for subSlicer's io.Writer implementation
+func (s *subSlicer) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		chunk := min(int64(len(p)), s.sub-s.written)
+		s.hash.Write(p[:chunk])
+		s.written += chunk
+		p = p[chunk:]
+		if s.written == s.sub {
+			s.flush()
+		}
+	}
+	return n, nil
+}
+
+// flush ends the current sub-slice, if anything was written to it
+func (s *subSlicer) flush() {
+	if s.written > 0 {
+		s.hashes = append(s.hashes, base64.StdEncoding.EncodeToString(s.hash.Sum(nil)))
+		s.hash.Reset()
+		s.written = 0
+	}
+}
+
+// take returns the sub-slice hashes written so far and starts over
+func (s *subSlicer) take() []string {
+	s.flush()
+	hashes := s.hashes
+	s.hashes = nil
+	return hashes
+}
+
+// splitSubSlices splits a hash dump slice line into the slice hash and its sub-slice hashes, if any
+func splitSubSlices(line string) (string, []string) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	return fields[0], fields[1:]
+}
+
+// narrower narrows different slices down to their different sub-slices,
+// hashing the local alike sub-slices on demand
+type narrower struct {
+	alike, hashing string
+	sub            int64
+	file           *os.File
+}
+
+// newNarrower returns a narrower for the local alike against a remote hash dump with the given header
+func newNarrower(alike string, header *dumpHeader) *narrower {
+	return &narrower{alike: alike, hashing: header.Hashing, sub: header.SubSlice}
+}
+
+// narrow adds to diffs the remote slice from pos to sliceEnd, comparing its sub-slice hashes against
+// the local alike sub-slices up to end (beyond end the local alike has no data to compare to)
+func (n *narrower) narrow(diffs *Diffs, subHashes []string, pos, sliceEnd, end int64) error {
+	if int64(len(subHashes)) != (sliceEnd-pos+n.sub-1)/n.sub {
+		segment := min(sliceEnd, end) - pos
+		diffs.add(Diff{pos, segment, true})
+		diffs.Differences += segment
+		return nil
+	}
+	if n.file == nil {
+		file, err := os.Open(n.alike)
+		if err != nil {
+			return err
+		}
+		n.file = file
+	}
+	sliceHash, err := newSliceHasher(n.hashing)
+	if err != nil {
+		return err
+	}
+	for k, subHash := range subHashes {
+		start := pos + int64(k)*n.sub
+		if start >= end {
+			break
+		}
+		subEnd := min(start+n.sub, sliceEnd)
+		if subEnd > end {
+			diffs.add(Diff{start, end - start, true})
+			diffs.Differences += end - start
+			break
+		}
+		sliceHash.Reset()
+		if _, err := io.Copy(sliceHash, io.NewSectionReader(n.file, start, subEnd-start)); err != nil {
+			return err
+		}
+		if base64.StdEncoding.EncodeToString(sliceHash.Sum(nil)) == subHash {
+			diffs.add(Diff{start, subEnd - start, false})
+		} else {
+			diffs.add(Diff{start, subEnd - start, true})
+			diffs.Differences += subEnd - start
+		}
+	}
+	return nil
+}
+
+// Close closes the local alike, if it was opened
+func (n *narrower) Close() error {
+	if n.file != nil {
+		return n.file.Close()
+	}
+	return nil
+}
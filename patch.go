@@ -0,0 +1,186 @@
+package slicesync
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	PatchExt = ".patch" + SliceSyncExt
+)
+
+// CreatePatch writes into patchfile the patch to turn the local alike into the local newfile,
+// sliced by slice, and returns the Diffs it follows
+//
+// A patch holds a "Patch: Version" line, the Diffs plan as a JSON line (including the expected whole file Hash and
+// the AlikeHash of the alike it applies to) and the contents of all the different segments in order
+func CreatePatch(patchfile, newfile, alike string, slice int64) (*Diffs, error) {
+	diffs, err := LocalDiffs(newfile, alike, slice)
+	if err != nil {
+		return nil, err
+	}
+	return diffs, writePatch(patchfile, &LocalHashNDump{"."}, diffs)
+}
+
+// CreateRemotePatch writes into patchfile the patch to turn the local alike into the remote fileurl,
+// sliced by slice, and returns the Diffs it follows
+func CreateRemotePatch(patchfile, fileurl, alike string, slice int64) (*Diffs, error) {
+	diffs, err := CalcDiffs(fileurl, alike, slice)
+	if err != nil {
+		return nil, err
+	}
+	return diffs, writePatch(patchfile, &RemoteHashNDump{diffs.Server}, diffs)
+}
+
+// CreatePatchFrom writes into patchfile the patch to turn the local alike into source, sliced by slice,
+// and returns the Diffs it follows
+// As for Verify, source is a local file if it exists, or else a remote file url (see CreateRemotePatch)
+func CreatePatchFrom(patchfile, source, alike string, slice int64) (*Diffs, error) {
+	if exists(source) {
+		return CreatePatch(patchfile, source, alike, slice)
+	}
+	return CreateRemotePatch(patchfile, source, alike, slice)
+}
+
+// LocalDiffs returns the Diffs to turn the local alike into the local newfile, hashing both on the fly
+func LocalDiffs(newfile, alike string, slice int64) (*Diffs, error) {
+	nc, err := hashStream(newfile, slice, NewSliceHasher())
+	if err != nil {
+		return nil, err
+	}
+	defer nc.Close()
+	lc, err := hashStream(alike, slice, NewSliceHasher())
+	if err != nil {
+		return nil, err
+	}
+	defer lc.Close()
+	remote := bufio.NewReader(nc)
+	header, err := readDumpHeader(remote, newfile)
+	if err != nil {
+		return nil, err
+	}
+	return naiveDiffs(NewDiffs("", newfile, alike, slice, header.Length), bufio.NewReader(lc), remote, header)
+}
+
+// hashStream returns the hash dump of the whole filename in fixed slices hashed by sliceHash, calculated on the fly
+func hashStream(filename string, slice int64, sliceHash NamedHash) (io.ReadCloser, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(hashRangeDump(w, file, filename, 0, fi.Size(), slice, sliceHash))
+	}()
+	return r, nil
+}
+
+// writePatch writes the patch following diffs into patchfile, taking the different segments from hnd
+func writePatch(patchfile string, hnd HashNDumper, diffs *Diffs) error {
+	file, err := os.OpenFile(patchfile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0750)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	w := bufio.NewWriterSize(file, bufferSize)
+	fmt.Fprintf(w, "Patch: %v\n", Version)
+	if err := json.NewEncoder(w).Encode(diffs); err != nil {
+		return err
+	}
+	for _, diff := range diffs.Diffs {
+		if !diff.Different {
+			continue
+		}
+		source, _, err := hnd.Dump(diffs.Filename, diff.Offset, diff.Size)
+		if err != nil {
+			return err
+		}
+		n, err := io.CopyN(w, source, diff.Size)
+		source.Close()
+		if err != nil {
+			return err
+		}
+		if n != diff.Size {
+			return fmt.Errorf("Expected to patch %v but patched %v instead!", diff.Size, n)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// ApplyPatch applies patchfile to the local alike to produce destfile, and returns the Diffs followed
+//
+// The alike must match the AlikeHash the patch was created for, and the result must match its Hash,
+// otherwise destfile is left untouched (patches apply offline, the server is never contacted)
+// destfile is the patched file name in the patch if empty, alike is the same as destfile if empty
+func ApplyPatch(patchfile, destfile, alike string) (*Diffs, error) {
+	file, err := os.Open(patchfile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	r := bufio.NewReaderSize(file, bufferSize)
+	diffs, err := readPatchHeader(r)
+	if err != nil {
+		return nil, fmt.Errorf("Patch %v header error: %v", patchfile, err)
+	}
+	if destfile == "" {
+		destfile = filepath.Base(diffs.Filename)
+	}
+	if alike == "" {
+		alike = destfile
+	}
+	diffs.Alike = alike
+	if alikeHash, err := fileHash(alike); err != nil {
+		return nil, err
+	} else if alikeHash != diffs.AlikeHash {
+		return nil, fmt.Errorf("Alike %v does not match the patch: expected hash %v but got %v!",
+			alike, diffs.AlikeHash, alikeHash)
+	}
+	tmpfile := destfile + ".tmp" + PatchExt
+	offline := *diffs // patches apply offline, never retrying bad slices from the server
+	offline.Server = ""
+	_, hash, err := writeDiffs(tmpfile, &offline, func(diff Diff) (io.ReadCloser, error) {
+		return ioutil.NopCloser(io.LimitReader(r, diff.Size)), nil
+	})
+	if err == nil && hash != diffs.Hash {
+		err = fmt.Errorf("Hash check failed: expected %v but got %v!", diffs.Hash, hash)
+	}
+	if err != nil {
+		os.Remove(tmpfile)
+		return nil, err
+	}
+	return diffs, os.Rename(tmpfile, destfile)
+}
+
+// readPatchHeader reads the patch version and its Diffs plan
+func readPatchHeader(r *bufio.Reader) (*Diffs, error) {
+	version, err := readAttribute(r, "Patch")
+	if err != nil {
+		return nil, err
+	}
+	if version != Version {
+		return nil, fmt.Errorf("Patch version mismatch: Expecting %v but got %v!", Version, version)
+	}
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	diffs := &Diffs{}
+	if err := json.Unmarshal(line, diffs); err != nil {
+		return nil, err
+	}
+	return diffs, nil
+}
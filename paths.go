@@ -0,0 +1,197 @@
+package slicesync
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// SymlinkPolicy tells how the symbolic links within a served directory are handled
+type SymlinkPolicy int
+
+const (
+	SymlinksDeny   SymlinkPolicy = iota // Symlinks are neither served nor hashed
+	SymlinksWithin                      // Only symlinks resolving within the served directory are served and hashed
+	SymlinksFollow                      // All symlinks are served and hashed, even those leading out of the directory
+)
+
+// symlinkPolicies names each SymlinkPolicy
+var symlinkPolicies = []string{"deny", "within", "follow"}
+
+// String for SymlinkPolicy's fmt.Stringer implementation
+func (p SymlinkPolicy) String() string {
+	return symlinkPolicies[p]
+}
+
+// ParseSymlinkPolicy returns the SymlinkPolicy named name: deny, within or follow
+func ParseSymlinkPolicy(name string) (SymlinkPolicy, error) {
+	for i, policy := range symlinkPolicies {
+		if policy == name {
+			return SymlinkPolicy(i), nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown symlink policy %v!", name)
+}
+
+// Symlinks is the symlink policy when serving files and within HashDir
+// (HashDir never recurses into symlinked directories, whatever the policy)
+var Symlinks = SymlinksWithin
+
+// ServeHidden allows hidden files and directories, those named starting with '.', to be served and hashed
+// (the hash dumps directory is always served)
+var ServeHidden = false
+
+// contained tells whether fullpath is dir or any path inside it, both absolute and clean
+func contained(dir, fullpath string) bool {
+	return fullpath == dir || strings.HasPrefix(fullpath, strings.TrimSuffix(dir, string(filepath.Separator))+
+		string(filepath.Separator))
+}
+
+// hidden tells whether any element of the relative path rel is hidden,
+// but for the hash dumps directory at its start
+func hidden(rel string) bool {
+	elems := strings.Split(filepath.ToSlash(rel), "/")
+	if elems[0] == SlicesyncDir {
+		elems = elems[1:]
+	}
+	for _, elem := range elems {
+		if strings.HasPrefix(elem, ".") && elem != "." && elem != ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// servable checks that filename, relative to dir, can be served or hashed: it must be within dir,
+// not hidden unless ServeHidden and only go through the symlinks allowed by the Symlinks policy
+func servable(dir, filename string) error {
+	fulldir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	fullpath := filepath.Join(fulldir, filepath.FromSlash(filename))
+	if !contained(fulldir, fullpath) {
+		return fmt.Errorf("Illegal filename %s, not within %s!", filename, fulldir)
+	}
+	rel, err := filepath.Rel(fulldir, fullpath)
+	if err != nil {
+		return err
+	}
+	if !ServeHidden && hidden(rel) {
+		return fmt.Errorf("Hidden file %s is not served!", filename)
+	}
+	switch Symlinks {
+	case SymlinksDeny:
+		path := fulldir
+		for _, elem := range strings.Split(rel, string(filepath.Separator)) {
+			path = filepath.Join(path, elem)
+			fi, err := os.Lstat(path)
+			if err != nil {
+				return nil // nothing there to serve anyway
+			}
+			if fi.Mode()&os.ModeSymlink != 0 {
+				return fmt.Errorf("Symlink %s is not served!", filename)
+			}
+		}
+	case SymlinksWithin:
+		realpath, err := filepath.EvalSymlinks(fullpath)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		realdir, err := filepath.EvalSymlinks(fulldir)
+		if err != nil {
+			return err
+		}
+		if !contained(realdir, realpath) {
+			return fmt.Errorf("Symlink %s leads out of %s!", filename, fulldir)
+		}
+	}
+	return nil
+}
+
+// hashable returns the file info of the file (or directory) filename found at basedir as fi,
+// following it if it is an allowed symlink, and whether HashDir should hash it or recurse into it
+func hashable(basedir, filename string, fi os.FileInfo) (os.FileInfo, bool) {
+	if servable(basedir, filename) != nil {
+		return fi, false
+	}
+	if fi.Mode()&os.ModeSymlink == 0 {
+		return fi, true
+	}
+	target, err := os.Stat(filepath.Join(basedir, filename))
+	if err != nil || target.IsDir() {
+		return fi, false
+	}
+	return target, true
+}
+
+// guardPaths wraps h to only serve the servable paths of dir, as not found otherwise
+func guardPaths(dir string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := servable(dir, r.URL.Path); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// policyFS is an http.FileSystem for dir listing just its servable files
+// (and of those just the visible ones, if there is a visible filter)
+type policyFS struct {
+	dir     string
+	fs      http.FileSystem
+	visible func(relpath string) bool
+}
+
+// newPolicyFS returns the http.FileSystem to serve dir according to the Symlinks and ServeHidden policies
+func newPolicyFS(dir string) http.FileSystem {
+	return &policyFS{dir, http.Dir(dir), nil}
+}
+
+// fileServer serves the files of dir as http.FileServer on newPolicyFS(dir) does,
+// but listing just the directory entries visible to each request (see AccessControl.guard)
+func fileServer(dir string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		visible, _ := r.Context().Value(visibleKey).(func(string) bool)
+		http.FileServer(&policyFS{dir, http.Dir(dir), visible}).ServeHTTP(w, r)
+	})
+}
+
+// Open for policyFS's http.FileSystem implementation
+func (pfs *policyFS) Open(name string) (http.File, error) {
+	if err := servable(pfs.dir, name); err != nil {
+		return nil, os.ErrNotExist
+	}
+	f, err := pfs.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &policyFile{f, pfs.dir, name, pfs.visible}, nil
+}
+
+// policyFile is an http.File listing just its servable (and visible) directory entries
+type policyFile struct {
+	http.File
+	dir, name string
+	visible   func(relpath string) bool
+}
+
+// Readdir for policyFile's http.File implementation
+func (pf *policyFile) Readdir(count int) ([]os.FileInfo, error) {
+	fis, err := pf.File.Readdir(count)
+	servables := fis[:0]
+	for _, fi := range fis {
+		if servable(pf.dir, filepath.Join(pf.name, fi.Name())) == nil &&
+			(pf.visible == nil || pf.visible(path.Join("/", pf.name, fi.Name()))) {
+			servables = append(servables, fi)
+		}
+	}
+	return servables, err
+}
@@ -0,0 +1,103 @@
+package slicesync
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LoadDiffs loads a Diffs plan previously saved as JSON (such as the output of sdiff -plan)
+func LoadDiffs(planfile string) (*Diffs, error) {
+	file, err := os.Open(planfile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	diffs := &Diffs{}
+	if err := json.NewDecoder(file).Decode(diffs); err != nil {
+		return nil, fmt.Errorf("Plan %v error: %v", planfile, err)
+	}
+	if diffs.Server == "" || diffs.Filename == "" || diffs.Alike == "" {
+		return nil, fmt.Errorf("Plan %v is incomplete, Server, Filename and Alike are required!", planfile)
+	}
+	return diffs, nil
+}
+
+// SavePlan saves the diffs plan as JSON into planfile, to be loaded later with LoadDiffs
+func SavePlan(planfile string, diffs *Diffs) error {
+	file, err := os.OpenFile(planfile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0750)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.WriteString(diffs.Print() + "\n")
+	return err
+}
+
+// ApplyDiffs runs a previously calculated Diffs plan, maybe loaded with LoadDiffs,
+// downloading the remote file into destfile
+//
+// Before downloading, the remote Hash and the local AlikeHash must still match the plan
+// destfile is the remote filename if empty, alike overrides the plan Alike if not empty
+// destfile may be the alike itself, even for content defined chunks plans (see DownloadDiffs)
+func ApplyDiffs(diffs *Diffs, destfile, alike string) error {
+	if destfile == "" {
+		destfile = filepath.Base(diffs.Filename)
+	}
+	if alike != "" {
+		plan := *diffs
+		plan.Alike = alike
+		diffs = &plan
+	}
+	alikeHash, err := fileHash(diffs.Alike)
+	if err != nil {
+		return err
+	}
+	if alikeHash != diffs.AlikeHash {
+		return fmt.Errorf("Alike %v changed since the plan: expected hash %v but got %v!",
+			diffs.Alike, diffs.AlikeHash, alikeHash)
+	}
+	hash, err := remoteHash(diffs.Server, diffs.Filename)
+	if err != nil {
+		return err
+	}
+	if hash != diffs.Hash {
+		return fmt.Errorf("Remote %v changed since the plan: expected hash %v but got %v!",
+			diffs.Filename, diffs.Hash, hash)
+	}
+	_, localHash, err := DownloadDiffs(destfile, diffs)
+	if err != nil {
+		return fmt.Errorf("Download error: %v", err)
+	}
+	if localHash != diffs.Hash {
+		return fmt.Errorf("Hash check failed: expected %v but got %v!", diffs.Hash, localHash)
+	}
+	return nil
+}
+
+// remoteHash returns the whole file hash in the remote hash dump for filename at server
+func remoteHash(server, filename string) (string, error) {
+	remoteHnd := &RemoteHashNDump{server}
+	rm, err := remoteHnd.Hash(filename)
+	if err != nil {
+		return "", fmt.Errorf("Error opening remote diff source: %v", err)
+	}
+	defer rm.Close()
+	r := bufio.NewReader(rm)
+	if _, err := readDumpHeader(r, filename); err != nil {
+		return "", fmt.Errorf("Remote diff source header error: %v", err)
+	}
+	hname := NewHasher().Name() + ":"
+	for {
+		line, err := readString(r)
+		if err != nil {
+			return "", fmt.Errorf("Remote file hash error: %v", err)
+		}
+		if strings.HasPrefix(line, hname) {
+			return strings.TrimSpace(line[len(hname):]), nil
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package slicesync
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// offsetWriter writes sequentially into file from offset on, with WriteAt
+type offsetWriter struct {
+	file   *os.File
+	offset int64
+}
+
+// Write for offsetWriter's io.Writer implementation
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.file.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
+
+// Repair fixes the local filename in place to match the remote fileurl, rewriting just its bad slices
+//
+// The bad slices are found comparing filename with the remote hash dump (see Verify), and only those segments
+// are downloaded and written in place, then filename is truncated or extended to the remote Length, synced to disk
+// and its whole file hash confirmed. The Diffs returned mark the repaired segments as Different
+func Repair(fileurl, filename string) (*Diffs, error) {
+	if !exists(filename) {
+		return nil, fmt.Errorf("Local file %v to repair does not exist!", filename)
+	}
+	diffs, err := Verify(fileurl, filename)
+	if err != nil {
+		return nil, err
+	}
+	if diffs.Server == "" {
+		return nil, fmt.Errorf("Remote fileurl expected to repair %v, but got %v!", filename, fileurl)
+	}
+	file, err := os.OpenFile(filename, os.O_RDWR, 0750)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	different, done := remoteSegments(diffs)
+	defer done()
+	for _, diff := range diffs.Diffs {
+		if !diff.Different {
+			continue
+		}
+		source, err := different(diff)
+		if err != nil {
+			return nil, err
+		}
+		n, err := io.CopyN(&offsetWriter{file, diff.Offset}, source, diff.Size)
+		source.Close()
+		if err != nil {
+			return nil, err
+		}
+		if n != diff.Size {
+			return nil, fmt.Errorf("Expected to repair %v but repaired %v instead!", diff.Size, n)
+		}
+	}
+	if err := file.Truncate(diffs.Size); err != nil {
+		return nil, err
+	}
+	if err := file.Sync(); err != nil {
+		return nil, err
+	}
+	hash, err := fileHash(filename)
+	if err != nil {
+		return nil, err
+	}
+	if hash != diffs.Hash {
+		return nil, fmt.Errorf("Hash check failed: expected %v but got %v!", diffs.Hash, hash)
+	}
+	return diffs, nil
+}
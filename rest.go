@@ -3,22 +3,55 @@ package slicesync
 import (
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
 	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	SLICESYNC_HEADER = "X-Slicesync" // Response header listing the slicesync extensions supported by the server
+	SLICESYNC_PARAM  = "slicesync"   // Query parameter selecting a slicesync extension on a file url
+	HASHES           = "hashes"      // Extension calculating slice hashes on demand for a file range
+	DIFFS            = "diffs"       // Extension calculating the Diffs against an uploaded alike hash dump
+	BUNDLE           = "bundle"      // Extension serving all the different segments of a Diffs plan at once
+	PROOF            = "proof"       // Extension serving the Merkle proof of a slice
+	ROOT             = "root"        // Extension serving the signed hash dump without its slice hashes
 )
 
 // -- Server Side --
 
 // HashNServe starts both a hash service preparing hash dumps and an http to serve them and the normal files remotely
-func HashNServe(port int, dir string, slice int64, recursive bool) {
-	go HashService(dir, slice, recursive, DEFAULT_PERIOD)
-	ServeHashNDump(port, dir, "/")
+// The admin API of the hash service is served as well if there is AdminAccess, on AdminPort if set
+// It only returns if the server fails or after a graceful shutdown on SIGTERM or SIGINT (see ServeGracefully)
+func HashNServe(port int, dir string, slice int64, recursive bool) error {
+	service := NewHashingService(dir, slice, recursive, DEFAULT_PERIOD)
+	if err := service.Start(); err != nil {
+		return err
+	}
+	servers := []*http.Server{NewHashNDumpServer(port, dir, "/")}
+	if AdminAccess != nil {
+		admin := AdminHandler(service, AdminAccess)
+		if AdminPort == 0 || AdminPort == port {
+			servers[0].Handler = withAdmin(servers[0].Handler, admin)
+		} else {
+			servers = append(servers,
+				&http.Server{Addr: net.JoinHostPort(BindAddress, strconv.Itoa(AdminPort)), Handler: admin})
+		}
+	}
+	return ServeGracefully(service, servers...)
 }
 
 // SetupHashNDumpServer prepares a Handler for a HashNDumpServer
+// Files are served as allowed by the ServeHidden and Symlinks policies, and the metrics at MetricsPath,
+// all of them only to those authorized by Access, if any
 func SetupHashNDumpServer(dir, prefix string) http.Handler {
 	if !strings.HasSuffix(prefix, "/") {
 		prefix = "/" + prefix
@@ -29,39 +62,166 @@ func SetupHashNDumpServer(dir, prefix string) http.Handler {
 	//fmt.Println("prefix:", prefix)
 	smux := http.NewServeMux()
 	smux.HandleFunc("/favicon.ico", http.NotFound)
-	smux.Handle(prefix, filter(http.StripPrefix(prefix, http.FileServer(http.Dir(dir)))))
+	if MetricsPath != "" {
+		smux.Handle(MetricsPath, filter("/", adminGet(serveMetrics)))
+	}
+	smux.Handle(prefix, filter(prefix, compress(http.StripPrefix(prefix, guardPaths(dir, extensions(dir, prioritize(dir, fileServer(dir))))))))
 	//fmt.Printf("smux=%#v\n", smux)
 	return smux
 }
 
 // NewHashNDumpServer creates a new NewHashNDumpServer with the setup from SetupHashNDumpServer(dir,prefix)
+// listening on port at BindAddress
 func NewHashNDumpServer(port int, dir, prefix string) *http.Server {
-	return &http.Server{Addr: fmt.Sprintf(":%v", port), Handler: SetupHashNDumpServer(dir, prefix)}
+	return &http.Server{Addr: net.JoinHostPort(BindAddress, strconv.Itoa(port)), Handler: SetupHashNDumpServer(dir, prefix)}
 }
 
 // ServeHashNDump runs an HTTP Server created from NewHashNDumpServer to download Hashes and slice Dumps slices of files
-func ServeHashNDump(port int, dir, prefix string) {
-	NewHashNDumpServer(port, dir, prefix).ListenAndServe()
+// It serves HTTPS when there are CertFile and KeyFile, reloading them on SIGHUP (see ClientCAFile as well)
+// It only returns if the server fails
+func ServeHashNDump(port int, dir, prefix string) error {
+	return listenAndServe(NewHashNDumpServer(port, dir, prefix))
 }
 
-func filter(h http.Handler) http.Handler {
+// listenAndServe runs server as ServeHashNDump does
+func listenAndServe(server *http.Server) error {
+	if CertFile == "" && KeyFile == "" {
+		if ClientCAFile != "" {
+			return fmt.Errorf("Client certificates can only be required when serving HTTPS!")
+		}
+		return server.ListenAndServe()
+	}
+	reloader, err := newCertReloader(CertFile, KeyFile)
+	if err != nil {
+		return err
+	}
+	if server.TLSConfig, err = serverTLSConfig(reloader); err != nil {
+		return err
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer close(hup)
+	defer signal.Stop(hup)
+	go reloader.watch(hup)
+	return server.ListenAndServeTLS("", "")
+}
+
+// filter traces all requests, logging them to AccessLog if any and counting them in the metrics, and only lets through those authorized by Access,
+// if there is any, for files under the url prefix
+func filter(prefix string, h http.Handler) http.Handler {
+	return trace(prefix, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if Access == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		Access.guard(prefix, h).ServeHTTP(w, r)
+	}))
+}
+
+// prioritize marks each requested file at dir as Requested, so that its hash dump is prepared sooner if it is pending
+// (only existing files, or hash dumps of existing files, are marked)
+func prioritize(dir string, h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		//fmt.Println("url=", r.URL)
+		filename := file4slicesync(r.URL.Path)
+		if fi, err := os.Stat(filepath.Join(dir, filepath.FromSlash(filename))); err == nil && fi.Mode().IsRegular() {
+			Requested(filename)
+		}
 		h.ServeHTTP(w, r)
 	})
 }
 
+// extensions advertises the slicesync extensions supported and serves the file urls requesting any of them
+func extensions(dir string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(SLICESYNC_HEADER, strings.Join([]string{HASHES, DIFFS, BUNDLE, PROOF, ROOT}, ","))
+		switch r.URL.Query().Get(SLICESYNC_PARAM) {
+		case "":
+			h.ServeHTTP(w, r)
+		case HASHES:
+			serveHashes(dir, w, r)
+		case DIFFS:
+			serveDiffs(dir, w, r)
+		case BUNDLE:
+			serveBundle(dir, w, r)
+		case PROOF:
+			serveProof(dir, w, r)
+		case ROOT:
+			serveRoot(dir, w, r)
+		default:
+			http.Error(w, "Unsupported slicesync extension", http.StatusBadRequest)
+		}
+	})
+}
+
+// serveHashes serves the slice hashes of a file range calculated on demand
+// from the offset, length and slice query parameters
+func serveHashes(dir string, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	params := make([]int64, 3)
+	for i, name := range []string{"offset", "length", "slice"} {
+		value, err := strconv.ParseInt(query.Get(name), 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid %s: %v", name, err), http.StatusBadRequest)
+			return
+		}
+		params[i] = value
+	}
+	hnd := &LocalHashNDump{dir}
+	rc, err := hnd.HashRange(r.URL.Path, params[0], params[1], params[2])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer rc.Close()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.Copy(w, rc)
+}
+
 // -- Client Side --
 
+// serverExtensions caches the slicesync extensions supported by each server
+var serverExtensions = struct {
+	sync.Mutex
+	m map[string][]string
+}{m: make(map[string][]string)}
+
+// supports tells whether the server advertises the given slicesync extension
+// The server is only probed while not cached yet, without holding the cache lock meanwhile
+func supports(server, extension string) bool {
+	serverExtensions.Lock()
+	extensions, ok := serverExtensions.m[server]
+	serverExtensions.Unlock()
+	if !ok {
+		r, err := http.DefaultClient.Head(calcUrl(server, SlicesyncDir+"/"))
+		if err != nil {
+			return false
+		}
+		r.Body.Close()
+		extensions = strings.Split(r.Header.Get(SLICESYNC_HEADER), ",")
+		serverExtensions.Lock()
+		serverExtensions.m[server] = extensions
+		serverExtensions.Unlock()
+	}
+	for _, supported := range extensions {
+		if strings.TrimSpace(supported) == extension {
+			return true
+		}
+	}
+	return false
+}
+
 // RemoteHashNDump implements HashNDumper service remotely through HTTP GET requests
 type RemoteHashNDump struct {
 	Server string
 }
 
-// Hash returns the remote stream of hash slices
+// Hash returns the remote stream of hash slices, once its signature is verified if there is a TrustedKey
 func (rhnd *RemoteHashNDump) Hash(filename string) (io.ReadCloser, error) {
 	r, _, e := get(calcUrl(rhnd.Server, SlicesyncFile(".", filename)), 0, 0)
-	return r, e
+	if e != nil {
+		return nil, e
+	}
+	return trustedDump(r, filename)
 }
 
 // Dump returns the contents of a remote slice of the file (or the full file)
@@ -70,8 +230,9 @@ func (rhnd *RemoteHashNDump) Dump(filename string, pos, slice int64) (io.ReadClo
 	if err != nil {
 		return nil, 0, err
 	}
-	N, err := strconv.ParseInt(r.Header.Get("Content-Length"), 10, 64)
+	N, err := decodedLength(r)
 	if err != nil {
+		rc.Close()
 		return nil, 0, err
 	}
 	return rc, N, err
@@ -127,6 +288,22 @@ func head(url string) error {
 	return nil
 }
 
+// remoteSize returns the current size of the remote url
+func remoteSize(url string) (int64, error) {
+	r, err := http.DefaultClient.Head(url)
+	if err != nil {
+		return 0, err
+	}
+	r.Body.Close()
+	if r.StatusCode != 200 {
+		return 0, fmt.Errorf("Unexpected status %v for %v!", r.Status, url)
+	}
+	if r.ContentLength < 0 {
+		return 0, fmt.Errorf("Unknown size for %v!", url)
+	}
+	return r.ContentLength, nil
+}
+
 // get a remote URL incoming stream
 func get(url string, pos, slice int64) (io.ReadCloser, *http.Response, error) {
 	//fmt.Printf("get %s\n", url)
@@ -134,6 +311,7 @@ func get(url string, pos, slice int64) (io.ReadCloser, *http.Response, error) {
 	if err != nil {
 		return nil, nil, err
 	}
+	acceptEncoding(get)
 	if pos != 0 || slice != 0 {
 		get.Header.Add("Range", fmt.Sprintf("bytes=%v-%v", pos, pos+slice-1))
 	}
@@ -147,7 +325,12 @@ func get(url string, pos, slice int64) (io.ReadCloser, *http.Response, error) {
 	if resp.StatusCode != 200 && resp.StatusCode != 206 {
 		return nil, nil, fmt.Errorf("Error " + resp.Status + " connecting to " + url)
 	}
-	return resp.Body, resp, nil
+	body, err := decode(resp)
+	if err != nil {
+		resp.Body.Close()
+		return nil, nil, err
+	}
+	return body, resp, nil
 }
 
 // calcUrl returns the Url for the remote file
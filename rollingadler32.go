@@ -12,6 +12,7 @@ type digest struct {
 	// invariant: (a < mod && b < mod) || a <= b
 	// invariant: a + b + 255 <= 0xffffffff
 	a, b uint32
+	buf  [Size]byte
 }
 
 func (d *digest) Reset() { d.a, d.b = 1, 0 }
@@ -98,7 +99,8 @@ func (d *digest) Roll32(window uint32, oldbyte, newbyte byte) uint32 {
 }
 
 // Roll calls Roll32 and returns the rolled checksum as a byte slice
+// (the returned slice is reused by the next Roll)
 func (d *digest) Roll(window uint32, oldbyte, newbyte byte) []byte {
 	d.Roll32(window, oldbyte, newbyte)
-	return d.Sum(nil)
+	return d.Sum(d.buf[:0])
 }
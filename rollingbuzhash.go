@@ -0,0 +1,67 @@
+package slicesync
+
+// buzTable is the buzhash random byte mapping table (always generated the same way)
+var buzTable [256]uint32
+
+func init() {
+	seed := uint64(0x62757a68617368) // splitmix64
+	for i := range buzTable {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		buzTable[i] = uint32(z ^ (z >> 31))
+	}
+}
+
+// buzhash represents the partial evaluation of a cyclic polynomial (buzhash) checksum.
+type buzhash struct {
+	h   uint32
+	buf [Size]byte
+}
+
+// NewRollingBuzhash returns a new RollingHash32 computing the buzhash checksum.
+func NewRollingBuzhash() RollingHash32 {
+	return new(buzhash)
+}
+
+func (d *buzhash) Reset() { d.h = 0 }
+
+func (d *buzhash) Size() int { return Size }
+
+func (d *buzhash) BlockSize() int { return 1 }
+
+// rotl rotates x left by n bits
+func rotl(x uint32, n uint32) uint32 {
+	n %= 32
+	return x<<n | x>>(32-n)
+}
+
+func (d *buzhash) Write(p []byte) (nn int, err error) {
+	for _, pi := range p {
+		d.h = rotl(d.h, 1) ^ buzTable[pi]
+	}
+	return len(p), nil
+}
+
+func (d *buzhash) Sum32() uint32 { return d.h }
+
+func (d *buzhash) Sum(in []byte) []byte {
+	s := d.h
+	return append(in, byte(s>>24), byte(s>>16), byte(s>>8), byte(s))
+}
+
+// Roll32 will displace the window checksum window by one position,
+// taking old-byte from the beginning and adding new-byte at the end
+// and returns the new current checksum 32bit state
+func (d *buzhash) Roll32(window uint32, oldbyte, newbyte byte) uint32 {
+	d.h = rotl(d.h, 1) ^ rotl(buzTable[oldbyte], window) ^ buzTable[newbyte]
+	return d.h
+}
+
+// Roll calls Roll32 and returns the rolled checksum as a byte slice
+// (the returned slice is reused by the next Roll)
+func (d *buzhash) Roll(window uint32, oldbyte, newbyte byte) []byte {
+	d.Roll32(window, oldbyte, newbyte)
+	return d.Sum(d.buf[:0])
+}
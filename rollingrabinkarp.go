@@ -0,0 +1,68 @@
+package slicesync
+
+const (
+	rkBase = 16777619 // Rabin-Karp polynomial base (the 32bit FNV prime), modulo 2^32
+)
+
+// rabinKarp represents the partial evaluation of a Rabin-Karp polynomial checksum.
+type rabinKarp struct {
+	h      uint32
+	window uint32 // window for which pow was calculated
+	pow    uint32 // rkBase^window
+	buf    [Size]byte
+}
+
+// NewRollingRabinKarp returns a new RollingHash32 computing a Rabin-Karp polynomial checksum.
+func NewRollingRabinKarp() RollingHash32 {
+	return &rabinKarp{pow: 1}
+}
+
+func (d *rabinKarp) Reset() { d.h = 0 }
+
+func (d *rabinKarp) Size() int { return Size }
+
+func (d *rabinKarp) BlockSize() int { return 1 }
+
+func (d *rabinKarp) Write(p []byte) (nn int, err error) {
+	for _, pi := range p {
+		d.h = d.h*rkBase + uint32(pi)
+	}
+	return len(p), nil
+}
+
+func (d *rabinKarp) Sum32() uint32 { return d.h }
+
+func (d *rabinKarp) Sum(in []byte) []byte {
+	s := d.h
+	return append(in, byte(s>>24), byte(s>>16), byte(s>>8), byte(s))
+}
+
+// power returns rkBase^window, only recalculating it when the window changes
+func (d *rabinKarp) power(window uint32) uint32 {
+	if window != d.window {
+		d.window = window
+		d.pow = 1
+		for b, e := uint32(rkBase), window; e > 0; e >>= 1 {
+			if e&1 == 1 {
+				d.pow *= b
+			}
+			b *= b
+		}
+	}
+	return d.pow
+}
+
+// Roll32 will displace the window checksum window by one position,
+// taking old-byte from the beginning and adding new-byte at the end
+// and returns the new current checksum 32bit state
+func (d *rabinKarp) Roll32(window uint32, oldbyte, newbyte byte) uint32 {
+	d.h = d.h*rkBase - uint32(oldbyte)*d.power(window) + uint32(newbyte)
+	return d.h
+}
+
+// Roll calls Roll32 and returns the rolled checksum as a byte slice
+// (the returned slice is reused by the next Roll)
+func (d *rabinKarp) Roll(window uint32, oldbyte, newbyte byte) []byte {
+	d.Roll32(window, oldbyte, newbyte)
+	return d.Sum(d.buf[:0])
+}
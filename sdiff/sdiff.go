@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"github.com/josvazg/slicesync"
 	"os"
@@ -20,18 +21,30 @@ func pct(bytes, total int64) float64 {
 }
 
 func main() {
-	if len(os.Args) < 3 {
+	var plan, key string
+	flag.StringVar(&plan, "plan", "", "(Optional) Save the Diffs plan into this file, to be run later by slicesync -plan")
+	flag.StringVar(&key, "key", "", "(Optional) Public key file the remote hash dumps must be signed with")
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 2 {
 		fmt.Printf(
-			"Usage: %v {fileurl} {local alike} (optional slice, 1MB by default)\n",
+			"Usage: %v [-plan planfile] [-key keyfile.pub] {fileurl} {local alike} (optional slice, 1MB by default)\n",
 			os.Args[0])
 		return
 	}
-	fileurl := os.Args[1]
-	alike := os.Args[2]
+	if key != "" {
+		var err error
+		if slicesync.TrustedKey, err = slicesync.LoadTrustedKey(key); err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	fileurl := args[0]
+	alike := args[1]
 	slice := int64(MiB)
-	if len(os.Args) > 3 {
+	if len(args) > 2 {
 		var err error
-		slice, err = strconv.ParseInt(os.Args[3], 10, 64)
+		slice, err = strconv.ParseInt(args[2], 10, 64)
 		if err != nil {
 			fmt.Println(err)
 			return
@@ -44,4 +57,9 @@ func main() {
 		return
 	}
 	fmt.Println(diffs.Print())
+	if plan != "" {
+		if err := slicesync.SavePlan(plan, diffs); err != nil {
+			fmt.Fprint(os.Stderr, err.Error()+"\n")
+		}
+	}
 }
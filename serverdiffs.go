@@ -0,0 +1,111 @@
+package slicesync
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+)
+
+const (
+	MAX_UPLOADED_DUMP = 256 * 1048576 // Maximum size of an alike hash dump uploaded to calculate the Diffs remotely
+)
+
+// DumpDiffs returns the Diffs between filename at dir, as already hashed there,
+// and an alike file known only by its hash dump, as done by the server for ServerDiffs
+//
+// The hash dump of filename must be of fixed size slices without sub-slices,
+// as the alike contents are not available to narrow down the different slices
+func DumpDiffs(dir, filename, alike string, alikeDump io.Reader) (*Diffs, error) {
+	hnd := &LocalHashNDump{dir}
+	rm, err := hnd.Hash(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening diff source: %v", err)
+	}
+	defer rm.Close()
+	remote := bufio.NewReader(rm)
+	header, err := readDumpHeader(remote, filename)
+	if err != nil {
+		return nil, fmt.Errorf("Diff source header error: %v", err)
+	}
+	if header.Chunking != nil || header.SubSlice != 0 {
+		return nil, fmt.Errorf("Hash dump for %v needs the alike contents to calculate the Diffs!", filename)
+	}
+	diffs := NewDiffs("", filename, alike, header.Slice, header.Length)
+	return naiveDiffs(diffs, bufio.NewReader(alikeDump), remote, header)
+}
+
+// serveDiffs serves the Diffs of the requested file against the alike hash dump POSTed by the client
+// Diffs that can not be calculated from the hash dumps are refused as unprocessable, for the client to calculate them
+func serveDiffs(dir string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "POST the alike hash dump to calculate the Diffs", http.StatusMethodNotAllowed)
+		return
+	}
+	alikeDump := http.MaxBytesReader(w, r.Body, MAX_UPLOADED_DUMP)
+	diffs, err := DumpDiffs(dir, r.URL.Path, r.URL.Query().Get("alike"), alikeDump)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diffs)
+}
+
+// unsupportedError is returned by ServerDiffs when the server does not calculate the Diffs requested,
+// either at all or from the hash dumps at hand, so that they can still be calculated locally
+type unsupportedError struct {
+	msg string
+}
+
+// Error for unsupportedError's error implementation
+func (e *unsupportedError) Error() string {
+	return e.msg
+}
+
+// ServerDiffs returns the Diffs between remote filename and local alike calculated by the server,
+// by uploading the local alike hash dump, instead of downloading the remote hash dump
+// (only servers supporting the "diffs" slicesync extension can do it, such as syncserver)
+func ServerDiffs(server, filename, alike string, slice int64) (*Diffs, error) {
+	if !supports(server, DIFFS) {
+		return nil, &unsupportedError{fmt.Sprintf("Remote server %v does not calculate Diffs!", server)}
+	}
+	localHnd := &LocalHashNDump{"."}
+	lc, err := localHnd.Hash(alike)
+	if err != nil {
+		return nil, &unsupportedError{fmt.Sprintf("Error opening local diff source: %v", err)}
+	}
+	defer lc.Close()
+	query := url.Values{}
+	query.Set(SLICESYNC_PARAM, DIFFS)
+	query.Set("alike", filepath.Base(alike))
+	resp, err := http.DefaultClient.Post(calcUrl(server, filename)+"?"+query.Encode(), "text/plain", lc)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnprocessableEntity {
+		return nil, &unsupportedError{fmt.Sprintf("Remote server %v can not calculate the Diffs for %v!",
+			server, filename)}
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Error %v calculating remote Diffs for %v!", resp.Status, filename)
+	}
+	body, err := decode(resp)
+	if err != nil {
+		return nil, err
+	}
+	diffs := &Diffs{}
+	if err := json.NewDecoder(body).Decode(diffs); err != nil {
+		return nil, err
+	}
+	if diffs.Slice != slice {
+		return nil, fmt.Errorf("Slice mismatch: Expecting %v but got %v!", slice, diffs.Slice)
+	}
+	diffs.Server, diffs.Filename, diffs.Alike = server, filename, alike
+	return diffs, nil
+}
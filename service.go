@@ -0,0 +1,380 @@
+package slicesync
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ShutdownTimeout is how long ServeGracefully waits for in-flight requests when shutting down
+var ShutdownTimeout = 30 * time.Second
+
+const (
+	DUMP_VALID   = "valid"   // The file hash dump is up to date
+	DUMP_PENDING = "pending" // The file is waiting to be hashed
+	DUMP_FAILED  = "failed"  // The file failed to be hashed on the last try
+	DUMP_SKIPPED = "skipped" // The file is no bigger than a slice, so it is not hashed in the background
+)
+
+// HashingRun holds the statistics of a hashing pass
+type HashingRun struct {
+	Path   string    `json:"path"`   // Path hashed, relative to the service directory, empty for the whole directory
+	Start  time.Time `json:"start"`  // When the pass started
+	End    time.Time `json:"end"`    // When the pass finished
+	Files  int64     `json:"files"`  // Files hashed
+	Bytes  int64     `json:"bytes"`  // Bytes of the files hashed
+	Errors int       `json:"errors"` // Errors found
+}
+
+// HashingStatus is the status of a HashingService
+type HashingStatus struct {
+	Running   bool       `json:"running"`              // Whether the service is started
+	Paused    bool       `json:"paused"`               // Whether hashing is paused
+	Hashing   bool       `json:"hashing"`              // Whether a hashing pass is in progress
+	Pending   int        `json:"pending"`              // Files waiting to be hashed on the current pass
+	Passes    int64      `json:"passes"`               // Hashing passes finished since the service was created
+	LastRun   HashingRun `json:"last_run"`             // Statistics of the last hashing pass finished
+	LastError string     `json:"last_error,omitempty"` // Last error found, if any
+}
+
+// ManagedFile is a file of the service directory and the status of its hash dump
+type ManagedFile struct {
+	Path     string    `json:"path"` // Relative to the service directory
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Dump     string    `json:"dump"`            // DUMP_VALID, DUMP_PENDING, DUMP_FAILED or DUMP_SKIPPED
+	Error    string    `json:"error,omitempty"` // Why it failed to be hashed
+}
+
+// HashingService keeps the hash dumps of a directory up to date, hashing it every Period
+// and whenever triggered, on its own go-routine between Start and Stop
+type HashingService struct {
+	Dir       string
+	Slice     int64
+	Recursive bool
+	Period    time.Duration
+	// OnError, when set, is called with the filename (or path hashed) and error of each hashing failure,
+	// instead of printing them to stderr; it is called from the service go-routines
+	OnError func(filename string, err error)
+
+	mutex     sync.Mutex
+	status    HashingStatus
+	queue     *hashQueue        // Queue of the pass in progress, if any
+	triggered []string          // Paths triggered to be hashed
+	trigger   chan struct{}     // Wakes up the service when triggered
+	stop      chan struct{}     // Closed to stop the service
+	done      chan struct{}     // Closed when the service is stopped
+	errors    int               // Errors found on the pass in progress
+	failures  map[string]string // filename -> error of the files that failed to be hashed
+}
+
+// NewHashingService creates a HashingService for dir with hash dumps of size slice,
+// recursive if asked to and hashing every period
+func NewHashingService(dir string, slice int64, recursive bool, period time.Duration) *HashingService {
+	return &HashingService{Dir: dir, Slice: slice, Recursive: recursive, Period: period,
+		trigger: make(chan struct{}, 1), failures: make(map[string]string)}
+}
+
+// Start starts the service on its own go-routine, with a first hashing pass right away
+func (s *HashingService) Start() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.status.Running {
+		return fmt.Errorf("Hashing service for %s already running!", s.Dir)
+	}
+	s.status.Running = true
+	s.stop, s.done = make(chan struct{}), make(chan struct{})
+	go s.serve(s.stop, s.done)
+	return nil
+}
+
+// Stop stops the service, dropping the files pending to be hashed, even those still being found
+// It waits for the hash dumps being written to be finished
+func (s *HashingService) Stop() {
+	s.mutex.Lock()
+	if !s.status.Running {
+		s.mutex.Unlock()
+		return
+	}
+	s.status.Running = false
+	close(s.stop)
+	if s.queue != nil {
+		s.queue.close()
+	}
+	done := s.done
+	s.mutex.Unlock()
+	<-done
+}
+
+// wait blocks until the service is stopped
+func (s *HashingService) wait() {
+	s.mutex.Lock()
+	done := s.done
+	s.mutex.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// Pause holds hashing until Resume, dropping the files pending to be hashed on the current pass
+// (hash dumps being written are finished) and keeping the triggered paths for later
+func (s *HashingService) Pause() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.status.Paused = true
+	if s.queue != nil {
+		s.queue.close()
+	}
+}
+
+// Resume resumes hashing after Pause, starting with the paths triggered meanwhile
+func (s *HashingService) Resume() {
+	s.mutex.Lock()
+	s.status.Paused = false
+	s.mutex.Unlock()
+	s.wakeUp()
+}
+
+// Trigger asks the running service to hash path, relative to Dir, as soon as possible:
+// a file is hashed if its hash dump is missing or stale, a directory as on a periodic pass
+func (s *HashingService) Trigger(path string) {
+	s.mutex.Lock()
+	s.triggered = append(s.triggered, path)
+	s.mutex.Unlock()
+	s.wakeUp()
+}
+
+// wakeUp signals the service to hash the triggered paths
+func (s *HashingService) wakeUp() {
+	select {
+	case s.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Rehash forces path, relative to Dir, to be hashed again as soon as possible (see Trigger):
+// the hash dumps of the file, or of all files within the directory, are removed first
+func (s *HashingService) Rehash(path string) error {
+	path = filepath.Clean(path)
+	if err := servable(s.Dir, path); err != nil {
+		return err
+	}
+	fi, err := os.Stat(filepath.Join(s.Dir, path))
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		err = os.RemoveAll(slicesyncDir(s.Dir, path))
+	} else {
+		err = removeAll(SlicesyncFile(s.Dir, path), stateSlicesyncFile(s.Dir, path))
+	}
+	if err != nil {
+		return err
+	}
+	s.Trigger(path)
+	return nil
+}
+
+// removeAll removes the given files, if they exist
+func removeAll(filenames ...string) error {
+	for _, filename := range filenames {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Files lists the files managed by the service, those HashDir would hash, and the status of their hash dumps
+func (s *HashingService) Files() ([]ManagedFile, error) {
+	s.mutex.Lock()
+	failures := make(map[string]string, len(s.failures))
+	for filename, err := range s.failures {
+		failures[filename] = err
+	}
+	s.mutex.Unlock()
+	files := []ManagedFile{}
+	err := s.listDir("", func(filename string, fi os.FileInfo) {
+		file := ManagedFile{Path: filepath.ToSlash(filename), Size: fi.Size(), Modified: fi.ModTime()}
+		switch failure, failed := failures[filename]; {
+		case isHashFileValid(fi, SlicesyncFile(s.Dir, filename)):
+			file.Dump = DUMP_VALID
+		case failed:
+			file.Dump, file.Error = DUMP_FAILED, failure
+		case fi.Size() <= s.Slice:
+			file.Dump = DUMP_SKIPPED
+		default:
+			file.Dump = DUMP_PENDING
+		}
+		files = append(files, file)
+	})
+	return files, err
+}
+
+// listDir calls fn on each hashable file within reldir, recursively if the service is
+func (s *HashingService) listDir(reldir string, fn func(filename string, fi os.FileInfo)) error {
+	return foreachFileInDir(filepath.Join(s.Dir, reldir), func(fi os.FileInfo) error {
+		filename := filepath.Join(reldir, fi.Name())
+		fi, ok := hashable(s.Dir, filename, fi)
+		if !ok || fi.Name() == SlicesyncDir {
+			return nil
+		}
+		if !fi.IsDir() {
+			fn(filename, fi)
+		} else if s.Recursive {
+			return s.listDir(filename, fn)
+		}
+		return nil
+	})
+}
+
+// Status returns the current status of the service
+func (s *HashingService) Status() HashingStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	status := s.status
+	if s.queue != nil {
+		status.Pending = s.queue.len()
+	}
+	return status
+}
+
+// serve hashes the whole directory every Period and the triggered paths until stop is closed
+func (s *HashingService) serve(stop, done chan struct{}) {
+	defer close(done)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+			s.pass("")
+			timer.Reset(s.Period)
+		case <-s.trigger:
+			s.mutex.Lock()
+			paths := s.triggered
+			if s.status.Paused {
+				paths = nil
+			} else {
+				s.triggered = nil
+			}
+			s.mutex.Unlock()
+			for _, path := range paths {
+				s.pass(path)
+			}
+		}
+	}
+}
+
+// pass runs a hashing pass on path, the whole directory if empty, unless paused
+// The failures within path are forgotten, those files are retried
+func (s *HashingService) pass(path string) {
+	q := &hashQueue{onError: s.failed}
+	s.mutex.Lock()
+	if !s.status.Running || s.status.Paused {
+		s.mutex.Unlock()
+		return
+	}
+	for filename := range s.failures {
+		if within(path2slash(path), path2slash(filename)) {
+			delete(s.failures, filename)
+		}
+	}
+	s.queue, s.errors, s.status.Hashing = q, 0, true
+	s.mutex.Unlock()
+	run := HashingRun{Path: path, Start: time.Now()}
+	err := s.queuePath(q, path)
+	if err == nil {
+		err = q.run(s.Dir, s.Slice, HashWorkers)
+	}
+	if err != nil && !q.isClosed() {
+		s.failed(path, err)
+	}
+	run.End, run.Files, run.Bytes = time.Now(), q.hashed, q.bytes
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	run.Errors = s.errors
+	s.queue, s.status.Hashing, s.status.LastRun = nil, false, run
+	s.status.Passes++
+}
+
+// queuePath queues on q the files to be hashed at path, the whole directory if empty
+func (s *HashingService) queuePath(q *hashQueue, path string) error {
+	if e := os.MkdirAll(slicesyncDir(s.Dir, ""), 0750); e != nil {
+		return e
+	}
+	path = filepath.Clean(path)
+	if path == "." {
+		return hashDir(q, s.Dir, "", s.Slice, s.Recursive)
+	}
+	if err := servable(s.Dir, path); err != nil {
+		return err
+	}
+	fi, err := os.Stat(filepath.Join(s.Dir, path))
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return hashDir(q, s.Dir, path, s.Slice, s.Recursive)
+	}
+	if !isHashFileValid(fi, SlicesyncFile(s.Dir, path)) {
+		q.push(path, fi.Size())
+	}
+	return nil
+}
+
+// path2slash returns the relative path as an absolute slash separated one, "/" for the whole directory
+func path2slash(path string) string {
+	return filepath.ToSlash(filepath.Join("/", path))
+}
+
+// failed reports the error hashing filename
+func (s *HashingService) failed(filename string, err error) {
+	s.mutex.Lock()
+	s.errors++
+	s.status.LastError = err.Error()
+	s.failures[filepath.Clean(filename)] = err.Error()
+	s.mutex.Unlock()
+	if s.OnError != nil {
+		s.OnError(filename, err)
+	} else {
+		fmt.Fprint(os.Stderr, err.Error()+"\n")
+	}
+}
+
+// ServeGracefully runs the servers as ServeHashNDump does until a SIGTERM or SIGINT is received,
+// then stops accepting requests, waits up to ShutdownTimeout for those in-flight to finish
+// and stops the service, if any, waiting for the hash dumps being written
+// It returns nil after a graceful shutdown or the error of the first server failing
+func ServeGracefully(service *HashingService, servers ...*http.Server) error {
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(term)
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) { errs <- listenAndServe(server) }(server)
+	}
+	var err error
+	select {
+	case err = <-errs:
+	case <-term:
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		if e := server.Shutdown(ctx); e != nil && err == nil {
+			err = e
+		}
+	}
+	if service != nil {
+		service.Stop()
+	}
+	return err
+}
@@ -7,7 +7,9 @@ import (
 	"github.com/josvazg/slicesync"
 	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 )
 
 // toMiB translates bytes into MiBytes
@@ -24,7 +26,7 @@ func pct(bytes, total int64) float64 {
 func usage() {
 	fmt.Printf("Usage: %v filename\n", os.Args[0])
 	fmt.Printf("   or: %v [-hashdump filename]\n", os.Args[0])
-	fmt.Printf("   or: %v [-dir directory] [-slice size] [-service] [-r]\n", os.Args[0])
+	fmt.Printf("   or: %v [-dir directory] [-slice size] [-workers n] [-quiet duration] [-incremental] [-cdc] [-subslice size] [-merkle] [-sign keyfile] [-symlinks policy] [-hidden] [-service] [-r]\n", os.Args[0])
 	fmt.Printf("   or: %v [-help]\n\n", os.Args[0])
 	flag.PrintDefaults()
 }
@@ -55,12 +57,18 @@ func hashOnce(dir string, slice int64, recursive bool) {
 	}
 }
 
-// hashingService watches and re-hashes a directory every second or so
+// hashingService watches and re-hashes a directory every second or so,
+// until SIGTERM or SIGINT, finishing the hash dumps being written before exiting
 func hashingService(dir string, slice int64, recursive bool) {
 	dir, err := filepath.Abs(dir)
 	exitOnError(err)
 	fmt.Printf("Watching and Hashing directory '%s'%s...\n", dir, mode(recursive))
-	slicesync.HashService(dir, slice, recursive, slicesync.DEFAULT_PERIOD)
+	service := slicesync.NewHashingService(dir, slice, recursive, slicesync.DEFAULT_PERIOD)
+	exitOnError(service.Start())
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, os.Interrupt)
+	<-term
+	service.Stop()
 }
 
 // hashAFile calculates the whole file hash and displays it, just like shasum
@@ -92,13 +100,40 @@ func main() {
 	var hashdump string
 	var dir string
 	var help bool
+	var sign, symlinks string
 	flag.Int64Var(&slice, "slice", slicesync.MiB, "(Optional) Slice size")
 	flag.BoolVar(&recursive, "r", false, "Recursive Hash Dump directory preparation")
 	flag.BoolVar(&service, "service", false, "Service process to repeatedly prepare Bulkhash on this directory")
 	flag.StringVar(&hashdump, "hashdump", "", "Generate a hash dump of the given file")
 	flag.StringVar(&dir, "dir", ".", "Directory base of generated hash dumps")
+	flag.IntVar(&slicesync.HashWorkers, "workers", slicesync.HashWorkers, "Number of concurrent hashing workers")
+	flag.DurationVar(&slicesync.QuietPeriod, "quiet", slicesync.QuietPeriod,
+		"Time a file must remain unmodified before it is hashed")
+	flag.BoolVar(&slicesync.IncrementalHashing, "incremental", false,
+		"Only hash the appended tail of grown (append-only) files")
+	flag.BoolVar(&slicesync.ContentDefinedChunking, "cdc", false,
+		"Cut content defined chunks of slice size on average instead of fixed size slices")
+	flag.StringVar(&slicesync.SliceHashing, "hashing", slicesync.SliceHashing,
+		"Slice hashing algorithm: adler32+md5, buzhash+md5 or rabinkarp+md5")
+	flag.Int64Var(&slicesync.SubSlice, "subslice", 0, "(Optional) Sub-slice size to also hash within each slice")
+	flag.BoolVar(&slicesync.MerkleTree, "merkle", false,
+		"End hash dumps with a Merkle root over the slice hashes, to verify single slices")
+	flag.StringVar(&symlinks, "symlinks", slicesync.Symlinks.String(),
+		"Symlink policy: deny, within (only those resolving within the directory) or follow")
+	flag.BoolVar(&slicesync.ServeHidden, "hidden", false, "Serve and hash hidden files (named starting with '.')")
+	flag.StringVar(&sign, "sign", "", "(Optional) Private key file to sign the hash dumps with (see skeygen)")
 	flag.BoolVar(&help, "help", false, "Show command help")
 	flag.Parse()
+	policy, err := slicesync.ParseSymlinkPolicy(symlinks)
+	exitOnError(err)
+	slicesync.Symlinks = policy
+	if sign != "" {
+		slicesync.SigningKey, err = slicesync.LoadSigningKey(sign)
+		exitOnError(err)
+	}
+	if _, ok := slicesync.SliceHashings[slicesync.SliceHashing]; !ok {
+		exitOnError(fmt.Errorf("Unknown slice hashing %v!", slicesync.SliceHashing))
+	}
 	if help {
 		usage()
 	} else if service {
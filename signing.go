@@ -0,0 +1,194 @@
+package slicesync
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	SIGNATURE    = "ed25519" // Signature trailer attribute name in the signed .slicesync hash dumps
+	KEY_ID       = "Key Id"  // Signing key id header attribute name in the signed .slicesync hash dumps
+	PublicKeyExt = ".pub"    // Public key file extension, next to the private key file (see GenerateKeys)
+)
+
+// SigningKey, when set, makes HashFile sign the hash dumps with it
+//
+// The signature covers the header, the whole file hash and the Merkle root lines of the dump, and the path
+// of the file relative to the served directory, so a dump cannot be passed off as that of a same named file
+// elsewhere. The slice hashes are covered through the Merkle root, so sign along with MerkleTree to have them
+// verified too (see signedContent)
+var SigningKey ed25519.PrivateKey
+
+// TrustedKey, when set, makes remote hash dumps be rejected unless they are signed with its private key
+// (Diffs calculated by the server are not signed, so they are calculated locally instead, see NaiveDiffs)
+var TrustedKey ed25519.PublicKey
+
+// KeyId returns the short id of a public key: the hex of the first 8 bytes of its SHA-256
+func KeyId(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return fmt.Sprintf("%x", sum[:8])
+}
+
+// GenerateKeys creates a new ed25519 key pair, saving the private key into keyfile
+// and the public one into keyfile+".pub", both base64 encoded
+func GenerateKeys(keyfile string) (ed25519.PublicKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := saveKey(keyfile, priv, 0600); err != nil {
+		return nil, err
+	}
+	return pub, saveKey(keyfile+PublicKeyExt, pub, 0644)
+}
+
+// saveKey writes the key base64 encoded into keyfile, failing if it already exists
+func saveKey(keyfile string, key []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(keyfile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(base64.StdEncoding.EncodeToString(key) + "\n")
+	if e := file.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// LoadSigningKey loads a private key saved by GenerateKeys
+func LoadSigningKey(keyfile string) (ed25519.PrivateKey, error) {
+	key, err := loadKey(keyfile, ed25519.PrivateKeySize)
+	return ed25519.PrivateKey(key), err
+}
+
+// LoadTrustedKey loads a public key saved by GenerateKeys
+func LoadTrustedKey(keyfile string) (ed25519.PublicKey, error) {
+	key, err := loadKey(keyfile, ed25519.PublicKeySize)
+	return ed25519.PublicKey(key), err
+}
+
+// loadKey loads a base64 encoded key of the given size from keyfile
+func loadKey(keyfile string, size int) ([]byte, error) {
+	data, err := ioutil.ReadFile(keyfile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("Key file %v error: %v", keyfile, err)
+	}
+	if len(key) != size {
+		return nil, fmt.Errorf("Key file %v has %v bytes, but %v were expected!", keyfile, len(key), size)
+	}
+	return key, nil
+}
+
+// signedContent returns what is signed of the hash dump for relpath, the file path relative to the served
+// directory: a "Path" line with it followed by the header lines and the whole file hash and Merkle root lines,
+// so that a small signed prefix of the dump is enough to verify them (see dumpSummary)
+func signedContent(dump []byte, relpath string) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "Path: %v\n", strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(relpath)), "/"))
+	for _, line := range bytes.SplitAfter(dumpSummary(dump), []byte("\n")) {
+		if !bytes.HasPrefix(line, []byte(SIGNATURE+":")) {
+			buf.Write(line)
+		}
+	}
+	return buf.Bytes()
+}
+
+// dumpSummary returns the hash dump without its slice hashes: just the header lines
+// and the whole file hash, Merkle root and signature lines
+func dumpSummary(dump []byte) []byte {
+	buf := &bytes.Buffer{}
+	header := true
+	for _, line := range bytes.SplitAfter(dump, []byte("\n")) {
+		if header || bytes.HasPrefix(line, []byte(NewHasher().Name()+":")) ||
+			bytes.HasPrefix(line, []byte(MERKLE+":")) || bytes.HasPrefix(line, []byte(SIGNATURE+":")) {
+			buf.Write(line)
+		}
+		if bytes.HasPrefix(line, []byte("Length:")) {
+			header = false
+		}
+	}
+	return buf.Bytes()
+}
+
+// signDump appends the signature line with key to the hash dump file hfilename for relpath
+func signDump(hfilename, relpath string, key ed25519.PrivateKey) error {
+	dump, err := ioutil.ReadFile(hfilename)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(hfilename, os.O_WRONLY|os.O_APPEND, 0750)
+	if err != nil {
+		return err
+	}
+	signature := ed25519.Sign(key, signedContent(dump, relpath))
+	_, err = fmt.Fprintf(file, "%v: %v\n", SIGNATURE, base64.StdEncoding.EncodeToString(signature))
+	if e := file.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// verifyDump checks that the hash dump for filename, relative to the served directory,
+// was signed with the private key of the trusted key
+func verifyDump(dump []byte, filename string, key ed25519.PublicKey) error {
+	header, err := readDumpHeader(bufio.NewReader(bytes.NewReader(dump)), filename)
+	if err != nil {
+		return err
+	}
+	if header.KeyId == "" {
+		return fmt.Errorf("Hash dump for %v is not signed!", filename)
+	}
+	if header.KeyId != KeyId(key) {
+		return fmt.Errorf("Hash dump for %v is signed with key %v, but %v was expected!",
+			filename, header.KeyId, KeyId(key))
+	}
+	lines := strings.Split(strings.TrimRight(string(dump), "\n"), "\n")
+	last := lines[len(lines)-1]
+	if !strings.HasPrefix(last, SIGNATURE+":") {
+		return fmt.Errorf("Hash dump for %v does not end with its signature!", filename)
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(last[len(SIGNATURE)+1:]))
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, signedContent(dump, filename), signature) {
+		return fmt.Errorf("Bad signature on hash dump for %v!", filename)
+	}
+	return nil
+}
+
+// trustedDump returns the hash dump for filename (relative to the served directory) read from rc,
+// once its signature is verified with TrustedKey, and its slice hashes with its Merkle root, if any
+// When there is no TrustedKey rc is returned as it is
+func trustedDump(rc io.ReadCloser, filename string) (io.ReadCloser, error) {
+	if TrustedKey == nil {
+		return rc, nil
+	}
+	defer rc.Close()
+	dump, err := ioutil.ReadAll(io.LimitReader(rc, MAX_UPLOADED_DUMP))
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyDump(dump, filename, TrustedKey); err != nil {
+		return nil, err
+	}
+	if err := checkMerkle(dump, filename); err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(dump)), nil
+}
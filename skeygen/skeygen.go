@@ -0,0 +1,50 @@
+// skeygen generates the ed25519 key pairs to sign and verify slicesync hash dumps
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/josvazg/slicesync"
+	"os"
+)
+
+// usage displays command usage information
+func usage() {
+	fmt.Printf("Usage: %v [-o keyfile]\n", os.Args[0])
+	fmt.Printf("   or: %v -id {keyfile.pub}\n", os.Args[0])
+	fmt.Printf("   or: %v [-help]\n\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+// exitOnError displays an error and exits if err is not null
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Fprint(os.Stderr, err.Error()+"\n")
+		os.Exit(-1)
+	}
+}
+
+func main() {
+	var keyfile, id string
+	var help bool
+	flag.StringVar(&keyfile, "o", "slicesync.key", "Private key file, the public key goes to the same file plus "+
+		slicesync.PublicKeyExt)
+	flag.StringVar(&id, "id", "", "Show the key id of the given public key file")
+	flag.BoolVar(&help, "help", false, "Show command help")
+	flag.Parse()
+	if help {
+		usage()
+		return
+	}
+	if id != "" {
+		key, err := slicesync.LoadTrustedKey(id)
+		exitOnError(err)
+		fmt.Println(slicesync.KeyId(key))
+		return
+	}
+	key, err := slicesync.GenerateKeys(keyfile)
+	exitOnError(err)
+	fmt.Printf("Private key saved in %v (syncserver/shash -sign)\n", keyfile)
+	fmt.Printf("Public key saved in %v (slicesync/sdiff -key)\n", keyfile+slicesync.PublicKeyExt)
+	fmt.Printf("Key Id: %v\n", slicesync.KeyId(key))
+}
@@ -3,6 +3,7 @@ package slicesync
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 )
@@ -16,7 +17,7 @@ import (
 // slice is the size of each of the slices to sync
 //
 // Algorithm:
-// 1. CalcDiffs
+// 1. CalcDiffs (zooming into the differences when ZoomSlice is set and the server supports it)
 // 2. DownloadDiffs
 // 3. Check local & remote hash
 // 4. If all is well the generated diff is returned
@@ -50,6 +51,11 @@ func Slicesync(fileurl, destfile, alike string, slice int64) (diffs *Diffs, err
 	if err != nil {
 		return nil, fmt.Errorf("Error calculating differences: %v", err)
 	}
+	if ZoomSlice > 0 && ZoomSlice < diffs.Slice && diffs.positional() && supports(server, HASHES) {
+		if err = Zoom(diffs, ZoomSlice); err != nil {
+			return nil, fmt.Errorf("Error zooming into differences: %v", err)
+		}
+	}
 	// 2. DownloadDiffs
 	_, localHash, err := DownloadDiffs(destfile, diffs)
 	if err != nil {
@@ -63,8 +69,62 @@ func Slicesync(fileurl, destfile, alike string, slice int64) (diffs *Diffs, err
 	return diffs, err
 }
 
-// DownloadDiffs downloads a filename by differences into destfile
+// DownloadDiffs downloads a filename by differences into destfile, which may be the alike itself
+// All the different segments are downloaded in a single bundle when the server supports it
 func DownloadDiffs(destfile string, diffs *Diffs) (downloaded int64, hash string, err error) {
+	different, done := remoteSegments(diffs)
+	defer done()
+	return writeDiffs(destfile, diffs, different)
+}
+
+// remoteSegments returns the function getting each different segment of diffs, in order, from the remote file
+// (from a single bundle when the server supports it) and the function to call when done
+func remoteSegments(diffs *Diffs) (different func(Diff) (io.ReadCloser, error), done func()) {
+	remoteHnd := &RemoteHashNDump{diffs.Server}
+	if diffs.Differences > 0 && supports(diffs.Server, BUNDLE) {
+		if bundle, err := remoteHnd.Bundle(diffs); err == nil {
+			return func(diff Diff) (io.ReadCloser, error) {
+				return ioutil.NopCloser(io.LimitReader(bundle, diff.Size)), nil
+			}, func() { bundle.Close() }
+		}
+	}
+	return func(diff Diff) (io.ReadCloser, error) {
+		source, _, err := remoteHnd.Dump(diffs.Filename, diff.Offset, diff.Size)
+		return source, err
+	}, func() {}
+}
+
+// writeDiffs writes destfile following diffs, taking the different segments from the different function
+// and the rest from the local alike, and returns the bytes written and their hash
+// When destfile is the alike itself or the diffs are not positional (content defined chunks may take
+// segments from anywhere in the alike) a temporary file is written instead, renamed to destfile only if
+// its hash matches the diffs Hash, so that the alike is never read after being overwritten
+// When diffs carries the remote slice Hashes, each slice written is verified and any bad one is downloaded again
+// (Diffs received from elsewhere never carry them, so they are only fetched if the whole file hash does not match)
+func writeDiffs(destfile string, diffs *Diffs, different func(Diff) (io.ReadCloser, error)) (
+	written int64, hash string, err error) {
+	if diffs.positional() && !sameFile(destfile, diffs.Alike) {
+		return writeFileDiffs(destfile, diffs, different)
+	}
+	tmpfile := destfile + TmpSliceSyncExt
+	written, hash, err = writeFileDiffs(tmpfile, diffs, different)
+	if err != nil || hash != diffs.Hash {
+		os.Remove(tmpfile)
+		return written, hash, err
+	}
+	return written, hash, os.Rename(tmpfile, destfile)
+}
+
+// sameFile tells whether both filenames are the same existing file
+func sameFile(filename1, filename2 string) bool {
+	fi1, err1 := os.Stat(filename1)
+	fi2, err2 := os.Stat(filename2)
+	return err1 == nil && err2 == nil && os.SameFile(fi1, fi2)
+}
+
+// writeFileDiffs performs the writeDiffs work writing straight into destfile
+func writeFileDiffs(destfile string, diffs *Diffs, different func(Diff) (io.ReadCloser, error)) (
+	written int64, hash string, err error) {
 	file, err := os.OpenFile(destfile, os.O_CREATE|os.O_WRONLY, 0750) // For write access
 	if err != nil {
 		return
@@ -73,30 +133,47 @@ func DownloadDiffs(destfile string, diffs *Diffs) (downloaded int64, hash string
 	h := NewHasher()
 	var source io.ReadCloser
 	sink := io.MultiWriter(file, h)
+	verifier := newSliceVerifier(diffs)
+	if verifier != nil {
+		sink = io.MultiWriter(file, h, verifier)
+	}
 	localHnd := &LocalHashNDump{"."}
-	remoteHnd := &RemoteHashNDump{diffs.Server}
-	done := int64(0)
 	for _, diff := range diffs.Diffs {
 		if diff.Different {
-			source, _, err = remoteHnd.Dump(diffs.Filename, diff.Offset, diff.Size)
+			source, err = different(diff)
 		} else {
 			source, _, err = localHnd.Dump(diffs.Alike, diff.Offset, diff.Size)
 		}
 		if err != nil {
-			return downloaded, "", err
+			return written, "", err
 		}
 		n, err := io.CopyN(sink, source, diff.Size)
 		source.Close()
 		if err != nil {
-			return downloaded, "", err
+			return written, "", err
 		}
 		if n != diff.Size {
-			return downloaded, "", fmt.Errorf("Expected to copy %v but copied %v instead!", diff.Size, n)
+			return written, "", fmt.Errorf("Expected to copy %v but copied %v instead!", diff.Size, n)
+		}
+		written += n
+	}
+	if err = file.Truncate(written); err != nil {
+		return written, "", err
+	}
+	hash = fmt.Sprintf("%x", h.Sum(nil))
+	if verifier == nil && hash != diffs.Hash {
+		verifier = fetchedSliceVerifier(destfile, diffs)
+	}
+	if verifier != nil {
+		if bad := verifier.bad(); len(bad) > 0 {
+			if bad = retrySlices(file, verifier.diffs, bad); len(bad) > 0 {
+				return written, "", &SliceError{bad}
+			}
+			hash, err = fileHash(destfile)
+			return written, hash, err
 		}
-		downloaded += n
-		done += n
 	}
-	return downloaded, fmt.Sprintf("%x", h.Sum(nil)), nil
+	return written, hash, nil
 }
 
 // Download simply downloads a URL to destfile (no hash calculus is done or returned)
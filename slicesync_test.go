@@ -1,16 +1,29 @@
 package slicesync_test
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/ed25519"
+	crand "crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"github.com/josvazg/slicesync"
 	"hash/adler32"
 	"io"
 	"io/ioutil"
+	"math/big"
+	"math/rand"
+	"net"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
 const (
@@ -42,6 +55,7 @@ func dieOnError(t *testing.T, err error) {
 }
 
 func prepare(t *testing.T) {
+	slicesync.QuietPeriod = 0
 	dieOnError(t, os.MkdirAll(testdir, 0750))
 	dieOnError(t, os.Chdir(testdir))
 }
@@ -282,3 +296,1483 @@ func TestSync(t *testing.T) {
 	}
 	dispose(t)
 }
+
+func TestHashWorkers(t *testing.T) {
+	prepare(t)
+	defer func(workers int) { slicesync.HashWorkers = workers }(slicesync.HashWorkers)
+	slicesync.HashWorkers = 4
+	files := []string{"w1.txt", "w2.txt", "dir/w3.txt", "dir/w4.txt", "dir/sub/w5.txt"}
+	dieOnError(t, os.MkdirAll("dir/sub", 0750))
+	for i, filename := range files {
+		content := strings.Repeat(testfile, i+1)
+		dieOnError(t, ioutil.WriteFile(filename, ([]byte)(content), 0750))
+	}
+	slicesync.Requested("dir/sub/w5.txt")
+	dieOnError(t, slicesync.HashDir(".", 10, true))
+	hashed := make(map[string]os.FileInfo)
+	for _, filename := range files {
+		if !slicesync.IsHashFileValid(".", filename) {
+			t.Fatalf("Expected %v file to have a valid hash dump!\n", filename)
+		}
+		fi, err := os.Stat(slicesync.SlicesyncFile(".", filename))
+		dieOnError(t, err)
+		hashed[filename] = fi
+	}
+	// a second pass must not re-hash anything
+	dieOnError(t, slicesync.HashDir(".", 10, true))
+	for _, filename := range files {
+		fi, err := os.Stat(slicesync.SlicesyncFile(".", filename))
+		dieOnError(t, err)
+		if !fi.ModTime().Equal(hashed[filename].ModTime()) {
+			t.Fatalf("Unexpected re-hashing of %v!\n", filename)
+		}
+	}
+	dispose(t)
+}
+
+func TestQuietPeriod(t *testing.T) {
+	prepare(t)
+	slicesync.QuietPeriod = time.Hour
+	dieOnError(t, ioutil.WriteFile("busy.txt", ([]byte)(testfile), 0750))
+	dieOnError(t, ioutil.WriteFile("quiet.txt", ([]byte)(testfile), 0750))
+	past := time.Now().Add(-2 * time.Hour)
+	dieOnError(t, os.Chtimes("quiet.txt", past, past))
+	dieOnError(t, os.MkdirAll(slicesync.SlicesyncDir, 0750))
+	stale := filepath.Join(slicesync.SlicesyncDir, "gone.txt"+slicesync.TmpSliceSyncExt)
+	fresh := filepath.Join(slicesync.SlicesyncDir, "busy.txt"+slicesync.TmpSliceSyncExt)
+	dieOnError(t, ioutil.WriteFile(stale, []byte("Version: 1\n"), 0750))
+	dieOnError(t, os.Chtimes(stale, past, past))
+	dieOnError(t, ioutil.WriteFile(fresh, []byte("Version: 1\n"), 0750))
+	dieOnError(t, slicesync.HashDir(".", 10, false))
+	if slicesync.IsHashFileValid(".", "busy.txt") {
+		t.Fatalf("Unexpected hash dump for the recently modified busy.txt!\n")
+	}
+	if !slicesync.IsHashFileValid(".", "quiet.txt") {
+		t.Fatalf("Expected quiet.txt file to have a valid hash dump!\n")
+	}
+	if _, err := os.Stat(stale); err == nil {
+		t.Fatalf("Expected stale %v to be removed!\n", stale)
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Fatalf("Expected recent %v to be kept, but got: %v\n", fresh, err)
+	}
+	slicesync.QuietPeriod = 0
+	dispose(t)
+}
+
+var incrementaltests = []struct {
+	content string
+	slice   int64
+}{
+	{testfile, 10},                                               // 0: slice aligned
+	{testfile + "FFFF", 10},                                      // 1: partial last slice
+	{testfile + "FFFFFFFFF\nGG", 10},                             // 2: partial last slice grows past the boundary
+	{"ZZZZZZZZZ\n" + likefile[10:] + "H", 10},                    // 3: rewritten, must not be reused
+	{"YYYYYYYYY\n" + likefile[10:] + "HHHHHHHHHHHHHHHHHHHH", 10}, // 4: rewritten and grown
+	{"YYYYYYYYY\n" + likefile[10:20] + "MMMMMMMMM\n" + likefile[30:] + "HHHHHHHHHHHHHHHHHHHHI", 10}, // 5: middle rewritten
+}
+
+func TestIncremental(t *testing.T) {
+	prepare(t)
+	defer func() { slicesync.IncrementalHashing = false }()
+	for i, it := range incrementaltests {
+		slicesync.IncrementalHashing = true
+		dieOnError(t, ioutil.WriteFile("grown.txt", ([]byte)(it.content), 0750))
+		dieOnError(t, slicesync.HashFile(".", "grown.txt", it.slice))
+		slicesync.IncrementalHashing = false
+		dieOnError(t, os.MkdirAll("full", 0750))
+		dieOnError(t, ioutil.WriteFile("full/grown.txt", ([]byte)(it.content), 0750))
+		dieOnError(t, slicesync.HashFile("full", "grown.txt", it.slice))
+		incremental, err := ioutil.ReadFile(slicesync.SlicesyncFile(".", "grown.txt"))
+		dieOnError(t, err)
+		full, err := ioutil.ReadFile(slicesync.SlicesyncFile("full", "grown.txt"))
+		dieOnError(t, err)
+		if string(incremental) != string(full) {
+			t.Fatalf("Test %d: Expected incremental hash dump\n%s\nbut got\n%s\n", i, full, incremental)
+		}
+	}
+	dispose(t)
+}
+
+// serve starts serving the current directory at port p, ready for requests when it returns
+func serve(t *testing.T, p int) {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%v", p))
+	dieOnError(t, err)
+	go http.Serve(l, slicesync.SetupHashNDumpServer(".", ""))
+}
+
+var tailtests = []struct {
+	local, remote string
+	appended      int64
+	fail          bool
+}{
+	{"", testfile, 60, false},            // 0: nothing local yet
+	{testfile[:20], testfile, 40, false}, // 1: slice aligned prefix
+	{testfile[:25], testfile, 35, false}, // 2: partial prefix
+	{testfile, testfile, 0, false},       // 3: nothing to append
+	{likefile[:30], testfile, 0, true},   // 4: not a prefix
+	{testfile, testfile[:30], 0, true},   // 5: remote shrank
+}
+
+func TestTail(t *testing.T) {
+	prepare(t)
+	p := port + 2
+	serve(t, p)
+	url := fmt.Sprintf("%v:%v/%v", host, p, "remote.txt")
+	for i, tt := range tailtests {
+		dieOnError(t, ioutil.WriteFile("remote.txt", ([]byte)(tt.remote), 0750))
+		dieOnError(t, slicesync.HashFile(".", "remote.txt", 10))
+		os.Remove("local.txt")
+		if tt.local != "" {
+			dieOnError(t, ioutil.WriteFile("local.txt", ([]byte)(tt.local), 0750))
+		}
+		diffs, err := slicesync.Tail(url, "local.txt")
+		if tt.fail {
+			if err == nil {
+				t.Fatalf("Test %d: Expected tail to fail!\n", i)
+			}
+			continue
+		}
+		dieOnError(t, err)
+		if diffs.Differences != tt.appended {
+			t.Fatalf("Test %d: Expected %d bytes appended, but got %d!\n", i, tt.appended, diffs.Differences)
+		}
+		local, err := ioutil.ReadFile("local.txt")
+		dieOnError(t, err)
+		if string(local) != tt.remote {
+			t.Fatalf("Test %d: Expected local contents '%s' but got '%s'!\n", i, tt.remote, local)
+		}
+	}
+	// a different partial last slice, with the remote grown past its hash dump so no whole hash is checked
+	dieOnError(t, ioutil.WriteFile("remote.txt", ([]byte)(testfile), 0750))
+	dieOnError(t, slicesync.HashFile(".", "remote.txt", 10))
+	dieOnError(t, ioutil.WriteFile("remote.txt", ([]byte)(testfile+testfile), 0750))
+	dieOnError(t, ioutil.WriteFile("local.txt", ([]byte)(testfile[:20]+"XXXXX"), 0750))
+	if _, err := slicesync.Tail(url, "local.txt"); err == nil {
+		t.Fatalf("Expected tail to fail on a different partial last slice!")
+	}
+	// a growing log, too small and recent to have a hash dump yet
+	dieOnError(t, ioutil.WriteFile("log.txt", ([]byte)(testfile[:14]), 0750))
+	dieOnError(t, slicesync.HashDir(".", 20, false)) // not hashed, as not larger than a slice
+	if _, err := os.Stat(slicesync.SlicesyncFile(".", "log.txt")); err == nil {
+		t.Fatalf("Expected no hash dump for log.txt yet!")
+	}
+	logurl := fmt.Sprintf("%v:%v/%v", host, p, "log.txt")
+	os.Remove("local.txt")
+	for i, remote := range []string{testfile[:14], testfile[:14], testfile[:45]} {
+		dieOnError(t, ioutil.WriteFile("log.txt", ([]byte)(remote), 0750))
+		_, err := slicesync.Tail(logurl, "local.txt")
+		dieOnError(t, err)
+		local, err := ioutil.ReadFile("local.txt")
+		dieOnError(t, err)
+		if string(local) != remote {
+			t.Fatalf("Log %d: Expected local contents '%s' but got '%s'!\n", i, remote, local)
+		}
+	}
+	dieOnError(t, ioutil.WriteFile("local.txt", ([]byte)(likefile[:30]), 0750))
+	if _, err := slicesync.Tail(logurl, "local.txt"); err == nil {
+		t.Fatalf("Expected tail to fail on a local file that is not a prefix of the log!")
+	}
+	dispose(t)
+}
+
+// chunkedFile returns the contents of a file to be cut into content defined chunks
+func chunkedFile() string {
+	lines := make([]string, 0, 2000)
+	for i := 0; i < cap(lines); i++ {
+		lines = append(lines, fmt.Sprintf("line %d of the chunked file\n", i))
+	}
+	return strings.Join(lines, "")
+}
+
+func TestChunkSync(t *testing.T) {
+	prepare(t)
+	defer func() { slicesync.ContentDefinedChunking = false }()
+	p := port + 3
+	serve(t, p)
+	remote := chunkedFile()
+	alike := remote[:100] + "INSERTED" + remote[100:len(remote)/2] + remote[len(remote)/2+7:]
+	dieOnError(t, ioutil.WriteFile("chunked.txt", ([]byte)(remote), 0750))
+	dieOnError(t, ioutil.WriteFile("alike.txt", ([]byte)(alike), 0750))
+	slicesync.ContentDefinedChunking = true
+	dieOnError(t, slicesync.HashFile(".", "chunked.txt", 256))
+	url := fmt.Sprintf("%v:%v/%v", host, p, "chunked.txt")
+	diffs, err := slicesync.Slicesync(url, "synced.txt", "alike.txt", 256)
+	dieOnError(t, err)
+	synced, err := ioutil.ReadFile("synced.txt")
+	dieOnError(t, err)
+	if string(synced) != remote {
+		t.Fatalf("Synced file differs from the remote chunked file!\n")
+	}
+	if diffs.Differences > 4*4*256 {
+		t.Fatalf("Expected just a few chunks downloaded, but got %d bytes of %d!\n", diffs.Differences, diffs.Size)
+	}
+	// In place, the remote has bytes inserted, so later chunks come from further back in the alike
+	dieOnError(t, ioutil.WriteFile("inplace.txt", ([]byte)(remote[:100]+remote[130:]), 0750))
+	_, err = slicesync.Slicesync(url, "inplace.txt", "", 256)
+	dieOnError(t, err)
+	synced, err = ioutil.ReadFile("inplace.txt")
+	dieOnError(t, err)
+	if string(synced) != remote {
+		t.Fatalf("File synced in place differs from the remote chunked file!\n")
+	}
+	dispose(t)
+}
+
+var rollinghashes = []struct {
+	name string
+	new  func() slicesync.RollingHash32
+}{
+	{"adler32", slicesync.NewRollingAdler32},
+	{"buzhash", slicesync.NewRollingBuzhash},
+	{"rabinkarp", slicesync.NewRollingRabinKarp},
+}
+
+func TestRollingHashes(t *testing.T) {
+	testdata, err := genTestData()
+	dieOnError(t, err)
+	for _, rh := range rollinghashes {
+		full := rh.new()
+		rolling := rh.new()
+		rolling.Write(testdata[0:Window])
+		for i := 1; i < len(testdata)-Window; i++ {
+			full.Reset()
+			full.Write(testdata[i : i+Window])
+			rolled := rolling.Roll(Window, testdata[i-1], testdata[i+Window-1])
+			if !bytes.Equal(full.Sum(nil), rolled) {
+				t.Fatalf("%s checksum at position %d expected was %x but got %x instead!",
+					rh.name, i, full.Sum(nil), rolled)
+			}
+		}
+		allocs := testing.AllocsPerRun(100, func() {
+			rolling.Roll(Window, testdata[0], testdata[Window])
+		})
+		if allocs != 0 {
+			t.Fatalf("%s Roll expected no allocations but got %v!", rh.name, allocs)
+		}
+	}
+}
+
+// collisions counts the repeated checksums of n random windows of the given size
+func collisions(newHash func() slicesync.RollingHash32, n, window int) int {
+	r := rand.New(rand.NewSource(1))
+	data := make([]byte, n+window)
+	r.Read(data)
+	h := newHash()
+	h.Write(data[:window])
+	seen := make(map[uint32]bool, n)
+	repeated := 0
+	for i := 0; i < n; i++ {
+		sum := h.Sum32()
+		if seen[sum] {
+			repeated++
+		}
+		seen[sum] = true
+		h.Roll32(uint32(window), data[i], data[i+window])
+	}
+	return repeated
+}
+
+func TestRollingCollisions(t *testing.T) {
+	const n = 100000
+	for _, window := range []int{16, 64, 1024} {
+		adler := collisions(slicesync.NewRollingAdler32, n, window)
+		for _, rh := range rollinghashes[1:] {
+			c := collisions(rh.new, n, window)
+			t.Logf("window %d: %s %d collisions vs adler32 %d (out of %d)", window, rh.name, c, adler, n)
+			// 2^32 checksums on 10^5 random windows should barely collide (birthday bound ~1.2)
+			if c > adler || c > 10 {
+				t.Fatalf("Window %d: %s got %d collisions, adler32 got %d!", window, rh.name, c, adler)
+			}
+		}
+	}
+}
+
+func benchmarkRoll(b *testing.B, newHash func() slicesync.RollingHash32) {
+	data := make([]byte, 1<<16)
+	rand.New(rand.NewSource(1)).Read(data)
+	h := newHash()
+	h.Write(data[:Window])
+	b.ReportAllocs()
+	b.SetBytes(1)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		j := i % (len(data) - Window)
+		h.Roll(Window, data[j], data[j+Window])
+	}
+}
+
+func BenchmarkRollAdler32(b *testing.B) {
+	benchmarkRoll(b, slicesync.NewRollingAdler32)
+}
+
+func BenchmarkRollBuzhash(b *testing.B) {
+	benchmarkRoll(b, slicesync.NewRollingBuzhash)
+}
+
+func BenchmarkRollRabinKarp(b *testing.B) {
+	benchmarkRoll(b, slicesync.NewRollingRabinKarp)
+}
+
+func TestSliceHashings(t *testing.T) {
+	prepare(t)
+	defer func() { slicesync.SliceHashing = "adler32+md5" }()
+	p := port + 4
+	serve(t, p)
+	dieOnError(t, ioutil.WriteFile("testfile.txt", ([]byte)(testfile), 0750))
+	dieOnError(t, ioutil.WriteFile("testfile2.txt", ([]byte)(likefile), 0750))
+	url := fmt.Sprintf("%v:%v/%v", host, p, "testfile.txt")
+	for name := range slicesync.SliceHashings {
+		slicesync.SliceHashing = name
+		dieOnError(t, slicesync.HashFile(".", "testfile.txt", 10))
+		dieOnError(t, slicesync.HashFile(".", "testfile2.txt", 10))
+		dump, err := ioutil.ReadFile(slicesync.SlicesyncFile(".", "testfile.txt"))
+		dieOnError(t, err)
+		if !strings.Contains(string(dump), "Slice Hashing: "+name+"\n") {
+			t.Fatalf("Expected %s in hash dump header, but got:\n%s\n", name, dump)
+		}
+		diffs, err := slicesync.Slicesync(url, "testfile2.txt", "", 10)
+		dieOnError(t, err)
+		if diffs.Differences != 30 {
+			t.Fatalf("%s: Expected 30 differences, but got %d!\n", name, diffs.Differences)
+		}
+		dieOnError(t, ioutil.WriteFile("testfile2.txt", ([]byte)(likefile), 0750))
+	}
+	dispose(t)
+}
+
+var multileveltests = []struct {
+	content            string
+	slice, subslice    int64
+	differences, diffs int64
+}{
+	{likefile, 30, 0, 60, 1},                  // 0: both slices differ
+	{likefile, 30, 10, 30, 4},                 // 1: narrowed down to the 10 bytes sub-slices
+	{likefile, 30, 7, 21, 7},                  // 2: sub-slices not aligned to the lines
+	{likefile[:35], 30, 10, 40, 2},            // 3: shorter alike
+	{likefile + likefile[:15], 30, 10, 30, 4}, // 4: longer alike
+	{likefile[:20], 10, 5, 40, 2},             // 5: alike shorter than several remote slices
+}
+
+func TestMultiLevel(t *testing.T) {
+	prepare(t)
+	defer func() { slicesync.SubSlice = 0 }()
+	p := port + 5
+	serve(t, p)
+	url := fmt.Sprintf("%v:%v/%v", host, p, "testfile.txt")
+	for i, mt := range multileveltests {
+		dieOnError(t, ioutil.WriteFile("testfile.txt", ([]byte)(testfile), 0750))
+		dieOnError(t, ioutil.WriteFile("alike.txt", ([]byte)(mt.content), 0750))
+		slicesync.SubSlice = mt.subslice
+		dieOnError(t, slicesync.HashFile(".", "testfile.txt", mt.slice))
+		slicesync.SubSlice = 0
+		dieOnError(t, slicesync.HashFile(".", "alike.txt", mt.slice))
+		diffs, err := slicesync.Slicesync(url, "synced.txt", "alike.txt", mt.slice)
+		dieOnError(t, err)
+		if diffs.Differences != mt.differences || int64(len(diffs.Diffs)) != mt.diffs {
+			t.Fatalf("Test %d: Expected %d differences in %d diffs, but got %d in %d!\n%v\n",
+				i, mt.differences, mt.diffs, diffs.Differences, len(diffs.Diffs), diffs)
+		}
+		os.Remove("synced.txt")
+	}
+	dispose(t)
+}
+
+var zoomtests = []struct {
+	content            string
+	slice, zoom        int64
+	differences, diffs int64
+}{
+	{likefile, 30, 0, 60, 1},                  // 0: no zoom
+	{likefile, 30, 10, 30, 4},                 // 1: zoomed into 10 bytes slices
+	{likefile, 30, 7, 18, 6},                  // 2: zoom slices aligned to the whole different region
+	{likefile[:35], 30, 10, 40, 2},            // 3: shorter alike
+	{likefile + likefile[:15], 30, 10, 30, 4}, // 4: longer alike
+}
+
+func TestZoom(t *testing.T) {
+	prepare(t)
+	defer func() { slicesync.ZoomSlice = 0 }()
+	p := port + 6
+	serve(t, p)
+	url := fmt.Sprintf("%v:%v/%v", host, p, "testfile.txt")
+	for i, mt := range zoomtests {
+		dieOnError(t, ioutil.WriteFile("testfile.txt", ([]byte)(testfile), 0750))
+		dieOnError(t, ioutil.WriteFile("alike.txt", ([]byte)(mt.content), 0750))
+		dieOnError(t, slicesync.HashFile(".", "testfile.txt", mt.slice))
+		dieOnError(t, slicesync.HashFile(".", "alike.txt", mt.slice))
+		slicesync.ZoomSlice = mt.zoom
+		diffs, err := slicesync.Slicesync(url, "synced.txt", "alike.txt", mt.slice)
+		dieOnError(t, err)
+		if diffs.Differences != mt.differences || int64(len(diffs.Diffs)) != mt.diffs {
+			t.Fatalf("Test %d: Expected %d differences in %d diffs, but got %d in %d!\n%v\n",
+				i, mt.differences, mt.diffs, diffs.Differences, len(diffs.Diffs), diffs)
+		}
+		os.Remove("synced.txt")
+	}
+	dispose(t)
+}
+
+func TestServerDiffs(t *testing.T) {
+	prepare(t)
+	p := port + 7
+	serve(t, p)
+	server := fmt.Sprintf("http://localhost:%v/", p)
+	dieOnError(t, ioutil.WriteFile("testfile.txt", ([]byte)(testfile), 0750))
+	for i, st := range synctests {
+		dieOnError(t, ioutil.WriteFile(st.filename, ([]byte)(st.content), 0750))
+		dieOnError(t, slicesync.HashFile(".", "testfile.txt", st.slice))
+		dieOnError(t, slicesync.HashFile(".", st.filename, st.slice))
+		diffs, err := slicesync.ServerDiffs(server, "testfile.txt", st.filename, st.slice)
+		dieOnError(t, err)
+		if diffs.Differences != st.differences || diffs.Alike != st.filename {
+			t.Fatalf("Test %d: Expected %d differences against %s, but got %d against %s!\n",
+				i, st.differences, st.filename, diffs.Differences, diffs.Alike)
+		}
+	}
+	slicesync.ContentDefinedChunking = true
+	err := slicesync.HashFile(".", "testfile.txt", 10)
+	slicesync.ContentDefinedChunking = false
+	dieOnError(t, err)
+	if _, err := slicesync.ServerDiffs(server, "testfile.txt", synctests[0].filename, 10); err == nil {
+		t.Fatalf("Expected chunked hash dumps to be refused by the server!")
+	}
+	if _, err := slicesync.NaiveDiffs(server, "testfile.txt", synctests[0].filename, 10); err != nil {
+		t.Fatalf("Expected chunked hash dumps to fall back to client side Diffs, but got %v", err)
+	}
+	failing := port + 26
+	l, err := net.Listen("tcp", fmt.Sprintf(":%v", failing))
+	dieOnError(t, err)
+	h := slicesync.SetupHashNDumpServer(".", "")
+	go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			http.Error(w, "Failing", http.StatusInternalServerError)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	server = fmt.Sprintf("http://localhost:%v/", failing)
+	if _, err := slicesync.NaiveDiffs(server, "testfile.txt", synctests[0].filename, 10); err == nil {
+		t.Fatalf("Expected the server error calculating the Diffs, not a silent fall back!")
+	}
+	dispose(t)
+}
+
+func TestBundle(t *testing.T) {
+	prepare(t)
+	p := port + 8
+	serve(t, p)
+	server := fmt.Sprintf("http://localhost:%v/", p)
+	dieOnError(t, ioutil.WriteFile("testfile.txt", ([]byte)(testfile), 0750))
+	st := synctests[0]
+	dieOnError(t, ioutil.WriteFile(st.filename, ([]byte)(st.content), 0750))
+	dieOnError(t, slicesync.HashFile(".", "testfile.txt", st.slice))
+	dieOnError(t, slicesync.HashFile(".", st.filename, st.slice))
+	diffs, err := slicesync.ServerDiffs(server, "testfile.txt", st.filename, st.slice)
+	dieOnError(t, err)
+	expected := ""
+	for _, diff := range diffs.Diffs {
+		if diff.Different {
+			expected += testfile[diff.Offset : diff.Offset+diff.Size]
+		}
+	}
+	remoteHnd := &slicesync.RemoteHashNDump{Server: server}
+	bundle, err := remoteHnd.Bundle(diffs)
+	dieOnError(t, err)
+	bundled, err := ioutil.ReadAll(bundle)
+	bundle.Close()
+	dieOnError(t, err)
+	if string(bundled) != expected {
+		t.Fatalf("Expected bundle\n%s\nbut got\n%s\n", expected, bundled)
+	}
+	diffs.Diffs = append(diffs.Diffs, slicesync.Diff{Offset: diffs.Size, Size: 10, Different: true})
+	if _, err := remoteHnd.Bundle(diffs); err == nil {
+		t.Fatalf("Expected a bundle beyond the end of the file to be refused!")
+	}
+	dispose(t)
+}
+
+func TestCompression(t *testing.T) {
+	prepare(t)
+	defer func() { slicesync.Compress = true }()
+	p := port + 9
+	serve(t, p)
+	server := fmt.Sprintf("http://localhost:%v/", p)
+	content := strings.Repeat(testfile, 100)
+	dieOnError(t, ioutil.WriteFile("big.txt", ([]byte)(content), 0750))
+	dieOnError(t, ioutil.WriteFile("big.gz", ([]byte)(content), 0750))
+	remoteHnd := &slicesync.RemoteHashNDump{Server: server}
+	for i, ct := range []struct {
+		compress         bool
+		filename         string
+		offset, size     int64
+		expectCompressed bool
+	}{
+		{true, "big.txt", 0, 0, true},       // 0: whole file
+		{false, "big.txt", 0, 0, false},     // 1: compression disabled
+		{true, "big.txt", 100, 4000, false}, // 2: ranges are never compressed
+		{true, "big.gz", 0, 0, false},       // 3: already compressed content type
+	} {
+		slicesync.Compress = ct.compress
+		wire, logical := slicesync.Transferred()
+		rc, n, err := remoteHnd.Dump(ct.filename, ct.offset, ct.size)
+		dieOnError(t, err)
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		dieOnError(t, err)
+		expected := content[ct.offset:]
+		if ct.size > 0 {
+			expected = content[ct.offset : ct.offset+ct.size]
+		}
+		if n != int64(len(expected)) || string(data) != expected {
+			t.Fatalf("Test %d: Expected %d bytes from %d but got %d:\n%s\n", i, len(expected), ct.offset, n, data)
+		}
+		endWire, endLogical := slicesync.Transferred()
+		wire, logical = endWire-wire, endLogical-logical
+		if logical != n || (ct.expectCompressed && wire >= logical) || (!ct.expectCompressed && wire != logical) {
+			t.Fatalf("Test %d: Unexpected %d bytes transferred for %d decoded!", i, wire, logical)
+		}
+	}
+	dispose(t)
+}
+
+func TestPatch(t *testing.T) {
+	prepare(t)
+	dieOnError(t, ioutil.WriteFile("testfile.txt", ([]byte)(testfile), 0750))
+	for i, st := range synctests {
+		dieOnError(t, ioutil.WriteFile(st.filename, ([]byte)(st.content), 0750))
+		diffs, err := slicesync.CreatePatch("test.patch", "testfile.txt", st.filename, st.slice)
+		dieOnError(t, err)
+		if diffs.Differences != st.differences {
+			t.Fatalf("Test %d: Expected %d differences to patch, but got %d!\n", i, st.differences, diffs.Differences)
+		}
+		_, err = slicesync.ApplyPatch("test.patch", "patched.txt", st.filename)
+		dieOnError(t, err)
+		patched, err := ioutil.ReadFile("patched.txt")
+		dieOnError(t, err)
+		if string(patched) != testfile {
+			t.Fatalf("Test %d: Expected patched file\n%s\nbut got\n%s\n", i, testfile, patched)
+		}
+		os.Remove("patched.txt")
+	}
+	dieOnError(t, ioutil.WriteFile(synctests[0].filename, ([]byte)(testfile[:30]), 0750))
+	if _, err := slicesync.ApplyPatch("test.patch", "patched.txt", synctests[0].filename); err == nil {
+		t.Fatalf("Expected the patch to refuse a different alike!")
+	}
+	if _, err := os.Stat("patched.txt"); err == nil {
+		t.Fatalf("Expected no patched file after a refused patch!")
+	}
+	p := port + 25
+	serve(t, p)
+	dieOnError(t, ioutil.WriteFile("alike.txt", ([]byte)(likefile), 0750))
+	dieOnError(t, slicesync.HashDir(".", 10, false))
+	url := fmt.Sprintf("%v:%v/%v", host, p, "testfile.txt")
+	for _, source := range []string{"testfile.txt", url} {
+		if diffs, err := slicesync.CreatePatchFrom("test.patch", source, "missing.txt", 10); err == nil || diffs != nil {
+			t.Fatalf("Expected an error creating a patch from %v for a missing alike, but got %v", source, diffs)
+		}
+	}
+	_, err := slicesync.CreatePatchFrom("test.patch", url, "alike.txt", 10)
+	dieOnError(t, err)
+	patch, err := ioutil.ReadFile("test.patch")
+	dieOnError(t, err)
+	patch[len(patch)-1] ^= 0xff
+	dieOnError(t, ioutil.WriteFile("test.patch", patch, 0750))
+	if _, err := slicesync.ApplyPatch("test.patch", "patched.txt", "alike.txt"); err == nil {
+		t.Fatalf("Expected a corrupted remote patch to fail offline, not to be fixed from its server!")
+	}
+	dispose(t)
+}
+
+func TestPlan(t *testing.T) {
+	prepare(t)
+	p := port + 10
+	serve(t, p)
+	url := fmt.Sprintf("%v:%v/%v", host, p, "testfile.txt")
+	st := synctests[0]
+	dieOnError(t, ioutil.WriteFile("testfile.txt", ([]byte)(testfile), 0750))
+	dieOnError(t, ioutil.WriteFile(st.filename, ([]byte)(st.content), 0750))
+	dieOnError(t, slicesync.HashFile(".", "testfile.txt", st.slice))
+	dieOnError(t, slicesync.HashFile(".", st.filename, st.slice))
+	diffs, err := slicesync.CalcDiffs(url, st.filename, st.slice)
+	dieOnError(t, err)
+	dieOnError(t, slicesync.SavePlan("test.plan", diffs))
+	if saved, err := ioutil.ReadFile("test.plan"); err != nil || strings.Contains(string(saved), "Hashes") {
+		t.Fatalf("Expected a plan without the remote slice hashes, but got %s (%v)", saved, err)
+	}
+	plan, err := slicesync.LoadDiffs("test.plan")
+	dieOnError(t, err)
+	dieOnError(t, slicesync.ApplyDiffs(plan, "planned.txt", ""))
+	planned, err := ioutil.ReadFile("planned.txt")
+	dieOnError(t, err)
+	if string(planned) != testfile {
+		t.Fatalf("Expected planned file\n%s\nbut got\n%s\n", testfile, planned)
+	}
+	dieOnError(t, ioutil.WriteFile("changed.txt", ([]byte)(st.content+"changed"), 0750))
+	if err := slicesync.ApplyDiffs(plan, "planned.txt", "changed.txt"); err == nil {
+		t.Fatalf("Expected the plan to refuse a changed alike!")
+	}
+	dieOnError(t, ioutil.WriteFile("testfile.txt", ([]byte)(likefile), 0750))
+	dieOnError(t, slicesync.HashFile(".", "testfile.txt", st.slice))
+	if err := slicesync.ApplyDiffs(plan, "planned.txt", ""); err == nil {
+		t.Fatalf("Expected the plan to refuse a changed remote file!")
+	}
+	// In place, content defined chunks after the bytes inserted remotely come from further back in the alike
+	defer func() { slicesync.ContentDefinedChunking = false }()
+	slicesync.ContentDefinedChunking = true
+	remote := chunkedFile()
+	dieOnError(t, ioutil.WriteFile("chunked.txt", ([]byte)(remote), 0750))
+	dieOnError(t, ioutil.WriteFile("inplace.txt", ([]byte)(remote[:100]+remote[130:]), 0750))
+	dieOnError(t, slicesync.HashFile(".", "chunked.txt", 256))
+	diffs, err = slicesync.CalcDiffs(fmt.Sprintf("%v:%v/%v", host, p, "chunked.txt"), "inplace.txt", 256)
+	dieOnError(t, err)
+	dieOnError(t, slicesync.ApplyDiffs(diffs, "inplace.txt", ""))
+	planned, err = ioutil.ReadFile("inplace.txt")
+	dieOnError(t, err)
+	if string(planned) != remote {
+		t.Fatalf("File planned in place differs from the remote chunked file!\n")
+	}
+	dispose(t)
+}
+
+var verifytests = []struct {
+	content          string
+	bad, differences int64
+}{
+	{testfile, 0, 0}, // 0: same file
+	{testfile[:25] + "XXXXX" + testfile[30:], 1, 10}, // 1: one bad slice
+	{testfile[:45], 1, 20},                           // 2: truncated
+	{testfile + "trailing", 0, 0},                    // 3: longer, yet not verified
+}
+
+func TestVerify(t *testing.T) {
+	prepare(t)
+	p := port + 11
+	serve(t, p)
+	url := fmt.Sprintf("%v:%v/%v", host, p, "testfile.txt")
+	dieOnError(t, ioutil.WriteFile("testfile.txt", ([]byte)(testfile), 0750))
+	dieOnError(t, slicesync.HashFile(".", "testfile.txt", 10))
+	for i, vt := range verifytests {
+		dieOnError(t, ioutil.WriteFile("local.txt", ([]byte)(vt.content), 0750))
+		for _, source := range []string{url, slicesync.SlicesyncFile(".", "testfile.txt")} {
+			diffs, err := slicesync.Verify(source, "local.txt")
+			dieOnError(t, err)
+			bad := int64(0)
+			for _, diff := range diffs.Diffs {
+				if diff.Different {
+					bad++
+				}
+			}
+			verified := vt.content == testfile
+			if bad != vt.bad || diffs.Differences != vt.differences ||
+				slicesync.Verified(diffs, "local.txt") != verified {
+				t.Fatalf("Test %d: Expected %d bad ranges of %d bytes (verified=%v) against %s, but got\n%v\n",
+					i, vt.bad, vt.differences, verified, source, diffs)
+			}
+		}
+	}
+	dispose(t)
+}
+
+func TestRepair(t *testing.T) {
+	prepare(t)
+	p := port + 12
+	serve(t, p)
+	url := fmt.Sprintf("%v:%v/%v", host, p, "testfile.txt")
+	dieOnError(t, ioutil.WriteFile("testfile.txt", ([]byte)(testfile), 0750))
+	dieOnError(t, slicesync.HashFile(".", "testfile.txt", 10))
+	for i, vt := range verifytests {
+		dieOnError(t, ioutil.WriteFile("local.txt", ([]byte)(vt.content), 0750))
+		diffs, err := slicesync.Repair(url, "local.txt")
+		dieOnError(t, err)
+		repaired, err := ioutil.ReadFile("local.txt")
+		dieOnError(t, err)
+		if string(repaired) != testfile || diffs.Differences != vt.differences {
+			t.Fatalf("Test %d: Expected %d bytes repaired into\n%s\nbut got %d bytes into\n%s\n",
+				i, vt.differences, testfile, diffs.Differences, repaired)
+		}
+	}
+	dispose(t)
+}
+
+func TestSliceVerification(t *testing.T) {
+	prepare(t)
+	p := port + 13
+	serve(t, p)
+	url := fmt.Sprintf("%v:%v/%v", host, p, "testfile.txt")
+	st := synctests[0]
+	dieOnError(t, ioutil.WriteFile("testfile.txt", ([]byte)(testfile), 0750))
+	dieOnError(t, ioutil.WriteFile(st.filename, ([]byte)(st.content), 0750))
+	dieOnError(t, slicesync.HashFile(".", "testfile.txt", st.slice))
+	dieOnError(t, slicesync.HashFile(".", st.filename, st.slice))
+	diffs, err := slicesync.CalcDiffs(url, st.filename, st.slice)
+	dieOnError(t, err)
+	// the alike gets corrupted after calculating the diffs, so its bad slice is downloaded again
+	corrupted := "XXXXXXXXXX" + st.content[10:]
+	dieOnError(t, ioutil.WriteFile(st.filename, ([]byte)(corrupted), 0750))
+	_, hash, err := slicesync.DownloadDiffs("verified.txt", diffs)
+	dieOnError(t, err)
+	verified, err := ioutil.ReadFile("verified.txt")
+	dieOnError(t, err)
+	if hash != diffs.Hash || string(verified) != testfile {
+		t.Fatalf("Expected the bad slice to be downloaded again, but got\n%s\n", verified)
+	}
+	// a slice that never verifies is reported, as the remote file changed without being hashed again
+	dieOnError(t, ioutil.WriteFile("testfile.txt", ([]byte)(testfile[:20]+"XXXXXXXXXX"+testfile[30:]), 0750))
+	_, _, err = slicesync.DownloadDiffs("verified.txt", diffs)
+	if serr, ok := err.(*slicesync.SliceError); !ok || len(serr.Ranges) != 1 ||
+		serr.Ranges[0] != (slicesync.Diff{Offset: 20, Size: 10, Different: true}) {
+		t.Fatalf("Expected slice verification to fail just at 20-30, but got %v", err)
+	}
+	dispose(t)
+}
+
+func TestMerkle(t *testing.T) {
+	prepare(t)
+	defer func() { slicesync.MerkleTree = false }()
+	p := port + 14
+	serve(t, p)
+	server := fmt.Sprintf("http://localhost:%v/", p)
+	remoteHnd := &slicesync.RemoteHashNDump{Server: server}
+	for n := 1; n <= 7; n++ { // all tree shapes from 1 to 7 slices
+		content := testfile[:n*8]
+		dieOnError(t, ioutil.WriteFile("merkle.txt", ([]byte)(content), 0750))
+		slicesync.MerkleTree = true
+		dieOnError(t, slicesync.HashFile(".", "merkle.txt", 8))
+		slicesync.MerkleTree = false
+		dump, err := ioutil.ReadFile(slicesync.SlicesyncFile(".", "merkle.txt"))
+		dieOnError(t, err)
+		lines := strings.Split(strings.TrimSpace(string(dump)), "\n")
+		root := strings.TrimPrefix(lines[len(lines)-1], "merkle-sha256: ")
+		for i := 0; i < n; i++ {
+			proof, err := remoteHnd.Proof("merkle.txt", int64(i))
+			dieOnError(t, err)
+			slice := ([]byte)(content[i*8 : i*8+8])
+			if err := proof.Verify(slice, root); err != nil {
+				t.Fatalf("Slice %d of %d: Unexpected error %v", i, n, err)
+			}
+			slice[0]++
+			if err := proof.Verify(slice, root); err == nil {
+				t.Fatalf("Slice %d of %d: Expected a tampered slice to fail verification!", i, n)
+			}
+		}
+	}
+	// A single slice verified with just the signed root and its proof
+	trusted, err := slicesync.GenerateKeys("merkle.key")
+	dieOnError(t, err)
+	signing, err := slicesync.LoadSigningKey("merkle.key")
+	dieOnError(t, err)
+	defer func() { slicesync.SigningKey, slicesync.TrustedKey = nil, nil }()
+	slicesync.SigningKey, slicesync.MerkleTree = signing, true
+	dieOnError(t, slicesync.HashFile(".", "merkle.txt", 8))
+	slicesync.SigningKey, slicesync.MerkleTree = nil, false
+	slicesync.TrustedKey = trusted
+	root, err := remoteHnd.Root("merkle.txt")
+	dieOnError(t, err)
+	proof, err := remoteHnd.Proof("merkle.txt", 3)
+	dieOnError(t, err)
+	rc, _, err := remoteHnd.Dump("merkle.txt", 24, 8)
+	dieOnError(t, err)
+	slice, err := ioutil.ReadAll(rc)
+	rc.Close()
+	dieOnError(t, err)
+	if err := proof.Verify(slice, root); err != nil {
+		t.Fatalf("Unexpected error %v verifying a slice against the signed root", err)
+	}
+	hfile := slicesync.SlicesyncFile(".", "merkle.txt")
+	dump, err := ioutil.ReadFile(hfile)
+	dieOnError(t, err)
+	tampered := strings.Replace(string(dump), "merkle-sha256: "+root, "merkle-sha256: "+strings.Repeat("0", len(root)), 1)
+	dieOnError(t, ioutil.WriteFile(hfile, ([]byte)(tampered), 0750))
+	if _, err := remoteHnd.Root("merkle.txt"); err == nil {
+		t.Fatalf("Expected a tampered Merkle root to be rejected!")
+	}
+	dispose(t)
+}
+
+func TestSigning(t *testing.T) {
+	prepare(t)
+	defer func() { slicesync.SigningKey, slicesync.TrustedKey, slicesync.MerkleTree = nil, nil, false }()
+	p := port + 15
+	serve(t, p)
+	url := fmt.Sprintf("%v:%v/%v", host, p, "testfile.txt")
+	st := synctests[0]
+	trusted, err := slicesync.GenerateKeys("trusted.key")
+	dieOnError(t, err)
+	signing, err := slicesync.LoadSigningKey("trusted.key")
+	dieOnError(t, err)
+	other, err := slicesync.GenerateKeys("other.key")
+	dieOnError(t, err)
+	dieOnError(t, ioutil.WriteFile("testfile.txt", ([]byte)(testfile), 0750))
+	dieOnError(t, ioutil.WriteFile(st.filename, ([]byte)(st.content), 0750))
+	dieOnError(t, slicesync.HashFile(".", st.filename, st.slice))
+	slicesync.SigningKey = signing
+	dieOnError(t, slicesync.HashFile(".", "testfile.txt", st.slice))
+	slicesync.SigningKey = nil
+	slicesync.TrustedKey = trusted
+	diffs, err := slicesync.CalcDiffs(url, st.filename, st.slice)
+	dieOnError(t, err)
+	if diffs.Differences != st.differences {
+		t.Fatalf("Expected %d differences but got %d!", st.differences, diffs.Differences)
+	}
+	slicesync.TrustedKey = other
+	if _, err := slicesync.CalcDiffs(url, st.filename, st.slice); err == nil {
+		t.Fatalf("Expected a dump signed with another key to be rejected!")
+	}
+	slicesync.TrustedKey = trusted
+	hfile := slicesync.SlicesyncFile(".", "testfile.txt")
+	dump, err := ioutil.ReadFile(hfile)
+	dieOnError(t, err)
+	tampered := strings.Replace(string(dump), "Length: 60", "Length: 50", 1)
+	dieOnError(t, ioutil.WriteFile(hfile, ([]byte)(tampered), 0750))
+	if _, err := slicesync.CalcDiffs(url, st.filename, st.slice); err == nil {
+		t.Fatalf("Expected a tampered dump to be rejected!")
+	}
+	// Slice hashes are only signed through the Merkle root
+	slicesync.SigningKey, slicesync.MerkleTree = signing, true
+	dieOnError(t, slicesync.HashFile(".", "testfile.txt", st.slice))
+	slicesync.SigningKey, slicesync.MerkleTree = nil, false
+	dump, err = ioutil.ReadFile(hfile)
+	dieOnError(t, err)
+	lines := strings.Split(string(dump), "\n")
+	for i, line := range lines {
+		if line != "" && !strings.Contains(line, ": ") {
+			lines[i] = strings.Repeat("A", len(line))
+			break
+		}
+	}
+	dieOnError(t, ioutil.WriteFile(hfile, ([]byte)(strings.Join(lines, "\n")), 0750))
+	if _, err := slicesync.CalcDiffs(url, st.filename, st.slice); err == nil {
+		t.Fatalf("Expected a dump with a tampered slice hash to be rejected!")
+	}
+	dieOnError(t, ioutil.WriteFile(hfile, dump, 0750))
+	_, err = slicesync.CalcDiffs(url, st.filename, st.slice)
+	dieOnError(t, err)
+	// Replayed for a file with the same name elsewhere
+	dieOnError(t, os.MkdirAll("sub", 0750))
+	dieOnError(t, ioutil.WriteFile("sub/testfile.txt", ([]byte)(testfile), 0750))
+	dieOnError(t, os.MkdirAll(filepath.Dir(slicesync.SlicesyncFile(".", "sub/testfile.txt")), 0750))
+	dieOnError(t, ioutil.WriteFile(slicesync.SlicesyncFile(".", "sub/testfile.txt"), dump, 0750))
+	replayed := fmt.Sprintf("%v:%v/%v", host, p, "sub/testfile.txt")
+	if _, err := slicesync.CalcDiffs(replayed, st.filename, st.slice); err == nil {
+		t.Fatalf("Expected a dump replayed for another file to be rejected!")
+	}
+	slicesync.TrustedKey = nil
+	dieOnError(t, slicesync.HashFile(".", "testfile.txt", st.slice))
+	slicesync.TrustedKey = trusted
+	if _, err := slicesync.CalcDiffs(url, st.filename, st.slice); err == nil {
+		t.Fatalf("Expected an unsigned dump to be rejected!")
+	}
+	dispose(t)
+}
+
+// writeCert writes a self-signed certificate for localhost, valid as its own CA, into name.pem and name.key
+func writeCert(t *testing.T, name string) {
+	pub, priv, err := ed25519.GenerateKey(crand.Reader)
+	dieOnError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{host},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	cert, err := x509.CreateCertificate(crand.Reader, template, template, pub, priv)
+	dieOnError(t, err)
+	key, err := x509.MarshalPKCS8PrivateKey(priv)
+	dieOnError(t, err)
+	dieOnError(t, ioutil.WriteFile(name+".pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0640))
+	dieOnError(t, ioutil.WriteFile(name+".key", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600))
+}
+
+// waitForServer waits for a server to be listening on port p
+func waitForServer(t *testing.T, p int) {
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", fmt.Sprintf("%v:%v", host, p))
+		if err == nil {
+			conn.Close()
+			return
+		}
+		if i == 100 {
+			t.Fatal(err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	prepare(t)
+	transport := http.DefaultClient.Transport
+	defer func() {
+		slicesync.BindAddress, slicesync.CertFile, slicesync.KeyFile, slicesync.ClientCAFile = "", "", "", ""
+		http.DefaultClient.Transport = transport
+	}()
+	p := port + 16
+	writeCert(t, "server")
+	writeCert(t, "client")
+	slicesync.BindAddress = "127.0.0.1"
+	slicesync.CertFile, slicesync.KeyFile, slicesync.ClientCAFile = "server.pem", "server.key", "client.pem"
+	go slicesync.ServeHashNDump(p, ".", "")
+	waitForServer(t, p)
+	url := fmt.Sprintf("https://%v:%v/%v", host, p, "testfile.txt")
+	st := synctests[0]
+	dieOnError(t, ioutil.WriteFile("testfile.txt", ([]byte)(testfile), 0750))
+	dieOnError(t, ioutil.WriteFile(st.filename, ([]byte)(st.content), 0750))
+	dieOnError(t, slicesync.HashFile(".", "testfile.txt", st.slice))
+	dieOnError(t, slicesync.HashFile(".", st.filename, st.slice))
+	dieOnError(t, slicesync.ClientTLS("", "", "server.pem"))
+	if _, err := slicesync.CalcDiffs(url, st.filename, st.slice); err == nil {
+		t.Fatalf("Expected a client without certificate to be rejected!")
+	}
+	dieOnError(t, slicesync.ClientTLS("client.pem", "client.key", "server.pem"))
+	diffs, err := slicesync.CalcDiffs(url, st.filename, st.slice)
+	dieOnError(t, err)
+	if diffs.Differences != st.differences {
+		t.Fatalf("Expected %d differences but got %d!", st.differences, diffs.Differences)
+	}
+	// a renewed server certificate is served after SIGHUP
+	writeCert(t, "server")
+	dieOnError(t, slicesync.ClientTLS("client.pem", "client.key", "server.pem"))
+	dieOnError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	for i := 0; ; i++ {
+		if _, err = slicesync.CalcDiffs(url, st.filename, st.slice); err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("Expected the renewed certificate to be served, but got %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	dispose(t)
+}
+
+var accesstests = []struct {
+	path, user, password, token string
+	status                      int
+}{
+	{"public/a.txt", "", "", "", 200},
+	{"private/b.txt", "", "", "", 401},
+	{"private/b.txt", "alice", "secret", "", 200},
+	{"private/b.txt", "alice", "wrong", "", 401},
+	{"private/b.txt", "bob", "myPassword", "", 403},
+	{"private/b.txt", "", "", "t0k3n", 200},
+	{"private/b.txt", "", "", "wrong", 401},
+	{".slicesync/private/b.txt.slicesync", "bob", "myPassword", "", 403},
+	{"private2/c.txt", "bob", "myPassword", "", 200},
+	{"private2/c.txt", "", "", "", 401},
+}
+
+func TestAccess(t *testing.T) {
+	prepare(t)
+	transport := http.DefaultClient.Transport
+	defer func() {
+		slicesync.Access = nil
+		http.DefaultClient.Transport = transport
+	}()
+	p := port + 17
+	serve(t, p)
+	dieOnError(t, ioutil.WriteFile("htpasswd", ([]byte)(
+		"alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\nbob:$apr1$r31abcde$kl9eNjSys8oZ/nHjspdaj0\n"), 0640))
+	dieOnError(t, ioutil.WriteFile("tokens", ([]byte)("ci:t0k3n\n"), 0640))
+	dieOnError(t, ioutil.WriteFile("rules", ([]byte)("# rules\n/public public\n/private alice ci\n"), 0640))
+	ac := slicesync.NewAccessControl()
+	dieOnError(t, ac.LoadUsers("htpasswd"))
+	dieOnError(t, ac.LoadTokens("tokens"))
+	dieOnError(t, ac.LoadRules("rules"))
+	ac.URLKey = []byte("urlkey")
+	slicesync.Access = ac
+	for _, dir := range []string{"public", "private", "private2"} {
+		dieOnError(t, os.MkdirAll(dir, 0750))
+	}
+	dieOnError(t, ioutil.WriteFile("public/a.txt", ([]byte)(testfile), 0750))
+	dieOnError(t, ioutil.WriteFile("private/b.txt", ([]byte)(testfile), 0750))
+	dieOnError(t, ioutil.WriteFile("private2/c.txt", ([]byte)(testfile), 0750))
+	dieOnError(t, slicesync.HashFile(".", "private/b.txt", 10))
+	for i, at := range accesstests {
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://%v:%v/%v", host, p, at.path), nil)
+		dieOnError(t, err)
+		if at.user != "" {
+			req.SetBasicAuth(at.user, at.password)
+		}
+		if at.token != "" {
+			req.Header.Set("Authorization", "Bearer "+at.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		dieOnError(t, err)
+		resp.Body.Close()
+		if resp.StatusCode != at.status {
+			t.Fatalf("Test %d: Expected status %d for %v, but got %v", i, at.status, at.path, resp.Status)
+		}
+	}
+	// hash dump listings just show the dumps of the files authorized
+	dieOnError(t, slicesync.HashFile(".", "private2/c.txt", 10))
+	for i, lt := range []struct {
+		user, password string
+		listed         bool
+	}{{"alice", "secret", true}, {"bob", "myPassword", false}} {
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://%v:%v/.slicesync/", host, p), nil)
+		dieOnError(t, err)
+		req.SetBasicAuth(lt.user, lt.password)
+		resp, err := http.DefaultClient.Do(req)
+		dieOnError(t, err)
+		listing, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		dieOnError(t, err)
+		if !strings.Contains(string(listing), `"private2/"`) ||
+			strings.Contains(string(listing), `"private/"`) != lt.listed {
+			t.Fatalf("Listing %d: Expected private/ to be listed to %v just if authorized, but got\n%s",
+				i, lt.user, listing)
+		}
+	}
+	// signed urls
+	fileurl := fmt.Sprintf("%v:%v/private/b.txt", host, p)
+	for i, st := range []struct {
+		url     string
+		expires time.Duration
+		status  int
+	}{{fileurl, time.Hour, 200}, {fileurl, -time.Hour, 401}, {fileurl + "x", time.Hour, 401}} {
+		signed, err := slicesync.SignURL(st.url, ac.URLKey, time.Now().Add(st.expires))
+		dieOnError(t, err)
+		resp, err := http.Get(strings.Replace(signed, "b.txtx", "b.txt", 1))
+		dieOnError(t, err)
+		resp.Body.Close()
+		if resp.StatusCode != st.status {
+			t.Fatalf("Signed url %d: Expected status %d, but got %v", i, st.status, resp.Status)
+		}
+	}
+	// slicesync with a bearer token
+	dieOnError(t, ioutil.WriteFile("alike.txt", ([]byte)(likefile), 0750))
+	dieOnError(t, slicesync.HashFile(".", "alike.txt", 10))
+	slicesync.ClientToken("t0k3n")
+	diffs, err := slicesync.CalcDiffs(fileurl, "alike.txt", 10)
+	dieOnError(t, err)
+	if diffs.Differences != 30 {
+		t.Fatalf("Expected 30 differences, but got %d!", diffs.Differences)
+	}
+	dispose(t)
+}
+
+var pathtests = []struct {
+	path   string
+	policy slicesync.SymlinkPolicy
+	hidden bool
+	status int
+	hashed bool
+}{
+	{"a.txt", slicesync.SymlinksDeny, false, 200, true},
+	{".slicesync/a.txt.slicesync", slicesync.SymlinksDeny, false, 200, false},
+	{".hidden", slicesync.SymlinksWithin, false, 404, false},
+	{".hidden", slicesync.SymlinksWithin, true, 200, true},
+	{"in", slicesync.SymlinksDeny, false, 404, false},
+	{"in", slicesync.SymlinksWithin, false, 200, true},
+	{"in", slicesync.SymlinksFollow, false, 200, true},
+	{"out", slicesync.SymlinksDeny, false, 404, false},
+	{"out", slicesync.SymlinksWithin, false, 404, false},
+	{"out", slicesync.SymlinksFollow, false, 200, true},
+	{"outdir/secret.txt", slicesync.SymlinksWithin, false, 404, false},
+	{"outdir/secret.txt", slicesync.SymlinksFollow, false, 200, false},
+	{"../served2/secret.txt", slicesync.SymlinksFollow, false, 404, false},
+	{"%2e%2e/served2/secret.txt", slicesync.SymlinksFollow, false, 404, false},
+}
+
+func TestPaths(t *testing.T) {
+	prepare(t)
+	defer func() { slicesync.Symlinks, slicesync.ServeHidden = slicesync.SymlinksWithin, false }()
+	p := port + 18
+	l, err := net.Listen("tcp", fmt.Sprintf(":%v", p))
+	dieOnError(t, err)
+	go http.Serve(l, slicesync.SetupHashNDumpServer("served", ""))
+	for _, dir := range []string{"served", "served2"} {
+		dieOnError(t, os.MkdirAll(dir, 0750))
+	}
+	dieOnError(t, ioutil.WriteFile("served/a.txt", ([]byte)(testfile), 0750))
+	dieOnError(t, ioutil.WriteFile("served/.hidden", ([]byte)(testfile), 0750))
+	dieOnError(t, ioutil.WriteFile("served2/secret.txt", ([]byte)(testfile), 0750))
+	dieOnError(t, os.Symlink("a.txt", "served/in"))
+	dieOnError(t, os.Symlink("../served2/secret.txt", "served/out"))
+	dieOnError(t, os.Symlink("../served2", "served/outdir"))
+	// containment is checked by whole path elements, so served2 is not within served
+	hnd := &slicesync.LocalHashNDump{Dir: "served"}
+	if _, _, err := hnd.Dump("../served2/secret.txt", 0, 0); err == nil {
+		t.Fatalf("Expected a file out of the served directory to be refused!")
+	}
+	client := &http.Client{} // following redirections, for the paths cleaned by the server
+	for i, pt := range pathtests {
+		slicesync.Symlinks, slicesync.ServeHidden = pt.policy, pt.hidden
+		dieOnError(t, os.RemoveAll("served/.slicesync"))
+		dieOnError(t, slicesync.HashDir("served", 10, true))
+		resp, err := client.Get(fmt.Sprintf("http://%v:%v/%v", host, p, pt.path))
+		dieOnError(t, err)
+		resp.Body.Close()
+		_, err = os.Stat(slicesync.SlicesyncFile("served", pt.path))
+		hashed := err == nil
+		if resp.StatusCode != pt.status || hashed != pt.hashed {
+			t.Fatalf("Test %d: Expected status %d (hashed=%v) for %v with symlinks %v (hidden=%v), but got %v (hashed=%v)",
+				i, pt.status, pt.hashed, pt.path, pt.policy, pt.hidden, resp.Status, hashed)
+		}
+	}
+	// directory listings only show what can be served
+	slicesync.Symlinks, slicesync.ServeHidden = slicesync.SymlinksWithin, false
+	resp, err := client.Get(fmt.Sprintf("http://%v:%v/", host, p))
+	dieOnError(t, err)
+	listing, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	dieOnError(t, err)
+	for _, name := range []string{".hidden", "out", "outdir"} {
+		if strings.Contains(string(listing), fmt.Sprintf(">%v<", name)) {
+			t.Fatalf("Expected %v not to be listed in\n%s", name, listing)
+		}
+	}
+	if !strings.Contains(string(listing), ">in<") {
+		t.Fatalf("Expected in to be listed in\n%s", listing)
+	}
+	dispose(t)
+}
+
+func TestAccessLog(t *testing.T) {
+	prepare(t)
+	r, w := io.Pipe()
+	defer func() { slicesync.AccessLog, slicesync.AccessLogFormat = nil, slicesync.LOG_COMMON }()
+	slicesync.AccessLog, slicesync.AccessLogFormat = w, slicesync.LOG_JSON
+	lines := make(chan string, 10) // log lines are written once responses are sent
+	go func() {
+		logs := bufio.NewReader(r)
+		for {
+			line, err := logs.ReadString('\n')
+			if err != nil {
+				close(lines)
+				return
+			}
+			lines <- line
+		}
+	}()
+	p := port + 19
+	serve(t, p)
+	dieOnError(t, ioutil.WriteFile("testfile.txt", ([]byte)(testfile), 0750))
+	fileurl := fmt.Sprintf("http://%v:%v/testfile.txt", host, p)
+	client := &http.Client{}
+	request := func(url, rng, id string) *http.Response {
+		req, err := http.NewRequest("GET", url, nil)
+		dieOnError(t, err)
+		req.Header.Set("Range", rng)
+		req.Header.Set("X-Request-Id", id)
+		resp, err := client.Do(req)
+		dieOnError(t, err)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+	resp := request(fileurl, "bytes=10-19", "sync-1")
+	line := <-lines
+	entry := map[string]interface{}{}
+	dieOnError(t, json.Unmarshal(([]byte)(line), &entry))
+	if resp.Header.Get("X-Request-Id") != "sync-1" || entry["request_id"] != "sync-1" ||
+		entry["path"] != "/testfile.txt" || entry["range"] != "bytes=10-19" || entry["status"] != 206.0 ||
+		entry["bytes"] != 10.0 || entry["client"] != "127.0.0.1" {
+		t.Fatalf("Unexpected response request id %v or log line\n%s", resp.Header.Get("X-Request-Id"), line)
+	}
+	// invalid request ids are replaced
+	slicesync.AccessLogFormat = slicesync.LOG_COMMON
+	resp = request(fmt.Sprintf("http://%v:%v/missing.txt", host, p), "", "bad id!")
+	line = <-lines
+	id := resp.Header.Get("X-Request-Id")
+	if len(id) != 32 || !strings.HasPrefix(line, "127.0.0.1 - - [") ||
+		!strings.Contains(line, "] \"GET /missing.txt HTTP/1.1\" 404 ") || !strings.HasSuffix(line, " "+id+"\n") {
+		t.Fatalf("Unexpected response request id %v or log line\n%s", id, line)
+	}
+	// only the names actually authenticated are logged
+	defer func() { slicesync.Access = nil }()
+	slicesync.Access = slicesync.NewAccessControl()
+	slicesync.Access.Tokens["secret"] = "ops"
+	for i, auth := range []struct{ user, password, token, logged string }{
+		{"", "", "secret", "ops"},
+		{"mallory", "guess", "", "-"},
+	} {
+		req, err := http.NewRequest("GET", fileurl, nil)
+		dieOnError(t, err)
+		if auth.token != "" {
+			req.Header.Set("Authorization", "Bearer "+auth.token)
+		} else {
+			req.SetBasicAuth(auth.user, auth.password)
+		}
+		resp, err := client.Do(req)
+		dieOnError(t, err)
+		resp.Body.Close()
+		if line = <-lines; !strings.HasPrefix(line, "127.0.0.1 - "+auth.logged+" [") {
+			t.Fatalf("Test %d: Expected %v to be logged as the user, but got\n%s", i, auth.logged, line)
+		}
+	}
+	w.Close()
+	dispose(t)
+}
+
+// readMetrics returns the metrics served at url to the bearer of token, if any, by name (labels included),
+// and the size of the response
+func readMetrics(t *testing.T, url, token string) (map[string]float64, int64) {
+	req, err := http.NewRequest("GET", url, nil)
+	dieOnError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	dieOnError(t, err)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the metrics, but got %v", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	dieOnError(t, err)
+	metrics := map[string]float64{}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		var name string
+		var value float64
+		if !strings.HasPrefix(scanner.Text(), "#") {
+			_, err := fmt.Sscan(scanner.Text(), &name, &value)
+			dieOnError(t, err)
+			metrics[name] = value
+		}
+	}
+	return metrics, int64(len(body))
+}
+
+func TestMetrics(t *testing.T) {
+	prepare(t)
+	defer func() { slicesync.Compress = true }()
+	slicesync.Compress = false // to count the bytes served exactly
+	p, ap := port+20, port+24
+	serve(t, p)
+	ac := slicesync.NewAccessControl()
+	ac.Tokens["secret"] = "ops"
+	l, err := net.Listen("tcp", fmt.Sprintf(":%v", ap))
+	dieOnError(t, err)
+	go http.Serve(l, slicesync.AdminHandler(slicesync.NewHashingService(".", 10, false, time.Hour), ac))
+	url := fmt.Sprintf("http://%v:%v/metrics", host, p)
+	before, scraped := readMetrics(t, url, "")
+	dieOnError(t, ioutil.WriteFile("testfile.txt", ([]byte)(testfile), 0750))
+	dieOnError(t, slicesync.HashDir(".", 10, false))
+	hnd := &slicesync.RemoteHashNDump{Server: fmt.Sprintf("http://%v:%v/", host, p)}
+	rc, err := hnd.Hash("testfile.txt")
+	dieOnError(t, err)
+	ioutil.ReadAll(rc)
+	rc.Close()
+	rc, _, err = hnd.Dump("testfile.txt", 10, 20)
+	dieOnError(t, err)
+	ioutil.ReadAll(rc)
+	rc.Close()
+	after, _ := readMetrics(t, url, "")
+	dump, err := ioutil.ReadFile(slicesync.SlicesyncFile(".", "testfile.txt"))
+	dieOnError(t, err)
+	for name, delta := range map[string]float64{
+		"slicesync_files_hashed_total":             1,
+		"slicesync_hashed_bytes_total":             float64(len(testfile)),
+		"slicesync_hash_queue_length":              0,
+		"slicesync_range_requests_total":           1,
+		`slicesync_requests_total{kind="dump"}`:    1,
+		`slicesync_requests_total{kind="file"}`:    1,
+		`slicesync_requests_total{kind="metrics"}`: 1,
+		"slicesync_served_bytes_total":             float64(int64(len(dump)+20) + scraped),
+	} {
+		if after[name]-before[name] != delta {
+			t.Fatalf("Expected %v to increase by %v, but went from %v to %v", name, delta, before[name], after[name])
+		}
+	}
+	if after["slicesync_hash_bytes_per_second"] <= 0 {
+		t.Fatalf("Expected some hashing speed, but got %v", after["slicesync_hash_bytes_per_second"])
+	}
+	// metrics are only served to those authorized, by Access or by the admin API access control
+	defer func() { slicesync.Access = nil }()
+	slicesync.Access = slicesync.NewAccessControl()
+	slicesync.Access.Tokens["scraper"] = "prometheus"
+	adminurl := fmt.Sprintf("http://%v:%v/admin/metrics", host, ap)
+	for _, url := range []string{url, adminurl} {
+		if resp, err := http.Get(url); err != nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("Expected no metrics for anyone at %v, but got %v %v", url, resp, err)
+		}
+	}
+	readMetrics(t, url, "scraper")
+	readMetrics(t, adminurl, "secret")
+	// admin requests are counted as well
+	if final, _ := readMetrics(t, url, "scraper"); final[`slicesync_requests_total{kind="admin"}`]-
+		after[`slicesync_requests_total{kind="admin"}`] != 2 {
+		t.Fatalf("Expected the 2 admin requests to be counted, but got %v", final)
+	}
+	dispose(t)
+}
+
+// waitForPasses waits for service to finish at least passes hashing passes
+func waitForPasses(t *testing.T, service *slicesync.HashingService, passes int64) slicesync.HashingStatus {
+	for i := 0; ; i++ {
+		status := service.Status()
+		if status.Passes >= passes {
+			return status
+		}
+		if i == 250 {
+			t.Fatalf("Expected %v hashing passes, but got %v", passes, status.Passes)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestHashingService(t *testing.T) {
+	prepare(t)
+	dieOnError(t, ioutil.WriteFile("testfile.txt", ([]byte)(testfile), 0750))
+	failures := make(chan string, 10)
+	service := slicesync.NewHashingService(".", 10, true, time.Hour)
+	service.OnError = func(filename string, err error) { failures <- filename }
+	dieOnError(t, service.Start())
+	if err := service.Start(); err == nil {
+		t.Fatal("Expected an error starting the service twice")
+	}
+	status := waitForPasses(t, service, 1)
+	if !status.Running || status.LastRun.Files != 1 || status.LastRun.Bytes != int64(len(testfile)) {
+		t.Fatalf("Unexpected status after the first pass %+v", status)
+	}
+	if _, err := os.Stat(slicesync.SlicesyncFile(".", "testfile.txt")); err != nil {
+		t.Fatal("Expected testfile.txt to be hashed")
+	}
+	dieOnError(t, ioutil.WriteFile("likefile.txt", ([]byte)(likefile), 0750))
+	service.Trigger("likefile.txt")
+	status = waitForPasses(t, service, 2)
+	_, err := os.Stat(slicesync.SlicesyncFile(".", "likefile.txt"))
+	if status.LastRun.Path != "likefile.txt" || status.LastRun.Files != 1 || err != nil {
+		t.Fatalf("Expected likefile.txt to be hashed when triggered, but got %+v", status.LastRun)
+	}
+	service.Trigger("missing.txt")
+	status = waitForPasses(t, service, 3)
+	if status.LastRun.Errors != 1 || status.LastError == "" || <-failures != "missing.txt" {
+		t.Fatalf("Expected missing.txt to fail, but got %+v", status)
+	}
+	service.Stop()
+	if service.Status().Running {
+		t.Fatal("Expected the service to be stopped")
+	}
+	// Stopped while walking a large directory, none of the files found later are hashed
+	dieOnError(t, os.MkdirAll("large", 0750))
+	for i := 0; i < 5000; i++ {
+		dieOnError(t, ioutil.WriteFile(fmt.Sprintf("large/%d.txt", i), ([]byte)(testfile), 0750))
+	}
+	service = slicesync.NewHashingService("large", 10, true, time.Hour)
+	dieOnError(t, service.Start())
+	for status = service.Status(); !status.Hashing && status.Passes == 0; status = service.Status() {
+	}
+	service.Stop()
+	if status = service.Status(); status.LastRun.Files >= 5000 {
+		t.Fatalf("Expected the pass to be stopped, but %v files were hashed", status.LastRun.Files)
+	}
+	// Graceful shutdown on SIGTERM
+	p := port + 21
+	service = slicesync.NewHashingService(".", 10, true, time.Hour)
+	dieOnError(t, service.Start())
+	errs := make(chan error, 1)
+	go func() { errs <- slicesync.ServeGracefully(service, slicesync.NewHashNDumpServer(p, ".", "/")) }()
+	waitForServer(t, p)
+	dieOnError(t, syscall.Kill(os.Getpid(), syscall.SIGTERM))
+	select {
+	case err := <-errs:
+		dieOnError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the server to shut down on SIGTERM")
+	}
+	if service.Status().Running {
+		t.Fatal("Expected the service to be stopped on shutdown")
+	}
+	dispose(t)
+}
+
+// admin calls the admin API endpoint at p with the given method and token, decoding the JSON reply into v
+func admin(t *testing.T, p int, method, endpoint, token string, v interface{}) int {
+	req, err := http.NewRequest(method, fmt.Sprintf("http://%v:%v/admin/%v", host, p, endpoint), nil)
+	dieOnError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	dieOnError(t, err)
+	defer resp.Body.Close()
+	if resp.StatusCode < 300 && v != nil {
+		dieOnError(t, json.NewDecoder(resp.Body).Decode(v))
+	}
+	return resp.StatusCode
+}
+
+// dumpStatus returns the hash dump status of filename listed by the admin API at p
+func dumpStatus(t *testing.T, p int, filename string) string {
+	files := []slicesync.ManagedFile{}
+	admin(t, p, "GET", "files", "secret", &files)
+	for _, file := range files {
+		if file.Path == filename {
+			return file.Dump
+		}
+	}
+	return ""
+}
+
+func TestAdmin(t *testing.T) {
+	prepare(t)
+	defer func() { slicesync.AdminAccess, slicesync.AdminPort = nil, 0 }()
+	dieOnError(t, ioutil.WriteFile("testfile.txt", ([]byte)(testfile), 0750))
+	p := port + 22
+	slicesync.AdminPort = port + 23
+	slicesync.AdminAccess = slicesync.NewAccessControl()
+	slicesync.AdminAccess.Tokens["secret"] = "ops"
+	slicesync.AdminAccess.Tokens["viewer"] = "viewer"
+	slicesync.AdminAccess.AddRule("/rehash", "ops")
+	errs := make(chan error, 1)
+	go func() { errs <- slicesync.HashNServe(p, ".", 10, true) }()
+	waitForServer(t, p)
+	waitForServer(t, slicesync.AdminPort)
+	status := slicesync.HashingStatus{}
+	if code := admin(t, slicesync.AdminPort, "GET", "status", "", nil); code != http.StatusUnauthorized {
+		t.Fatalf("Expected an unauthorized admin request, but got %v", code)
+	}
+	if code := admin(t, slicesync.AdminPort, "POST", "rehash?path=testfile.txt", "viewer", nil); code != http.StatusForbidden {
+		t.Fatalf("Expected a forbidden rehash, but got %v", code)
+	}
+	if code := admin(t, slicesync.AdminPort, "GET", "pause", "secret", nil); code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected pause to require POST, but got %v", code)
+	}
+	for i := 0; dumpStatus(t, slicesync.AdminPort, "testfile.txt") != slicesync.DUMP_VALID; i++ {
+		if i == 250 {
+			t.Fatal("Expected testfile.txt to be hashed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	admin(t, slicesync.AdminPort, "POST", "pause", "secret", &status)
+	if !status.Paused {
+		t.Fatalf("Expected the service to be paused, but got %+v", status)
+	}
+	if code := admin(t, slicesync.AdminPort, "POST", "rehash?path=testfile.txt", "secret", &status); code != http.StatusAccepted {
+		t.Fatalf("Expected the rehash to be accepted, but got %v", code)
+	}
+	if dump := dumpStatus(t, slicesync.AdminPort, "testfile.txt"); dump != slicesync.DUMP_PENDING {
+		t.Fatalf("Expected testfile.txt to be pending while paused, but got %v", dump)
+	}
+	if code := admin(t, slicesync.AdminPort, "POST", "rehash?path=../x", "secret", nil); code != http.StatusBadRequest {
+		t.Fatalf("Expected a bad rehash request out of the directory, but got %v", code)
+	}
+	admin(t, slicesync.AdminPort, "POST", "resume", "secret", &status)
+	for i := 0; dumpStatus(t, slicesync.AdminPort, "testfile.txt") != slicesync.DUMP_VALID; i++ {
+		if i == 250 {
+			t.Fatal("Expected testfile.txt to be hashed again after resuming")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if resp, err := http.Get(fmt.Sprintf("http://%v:%v/admin/status", host, p)); err != nil ||
+		resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected no admin API along with the files, but got %v %v", resp, err)
+	}
+	dieOnError(t, syscall.Kill(os.Getpid(), syscall.SIGTERM))
+	select {
+	case err := <-errs:
+		dieOnError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the server to shut down on SIGTERM")
+	}
+	dispose(t)
+}
@@ -0,0 +1,74 @@
+// spatch creates and applies offline slicesync patches
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/josvazg/slicesync"
+	"os"
+	"path/filepath"
+)
+
+// toMiB translates bytes into MiBytes
+func toMiB(bytes int64) float64 {
+	return float64(bytes) / slicesync.MiB
+}
+
+// usage displays command usage information
+func usage() {
+	fmt.Printf("Usage: %v -create [-o patchfile] [-slice bytes] {newfile|fileurl} {local alike}\n", os.Args[0])
+	fmt.Printf("   or: %v -apply [-to destination] [-alike localAlike] {patchfile}\n", os.Args[0])
+	fmt.Printf("   or: %v [-help]\n\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+// exitOnError displays an error and exits if err is not null
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Fprint(os.Stderr, err.Error()+"\n")
+		os.Exit(-1)
+	}
+}
+
+// create writes the patch to turn alike into newfile, a local file or else a remote url (maybe just host:port/file)
+func create(patchfile, newfile, alike string, slice int64) {
+	if patchfile == "" {
+		patchfile = filepath.Base(newfile) + slicesync.PatchExt
+	}
+	fmt.Printf("Patch %v from %v -> %v\n[slice=%v]\n", patchfile, alike, newfile, slice)
+	diffs, err := slicesync.CreatePatchFrom(patchfile, newfile, alike, slice)
+	exitOnError(err)
+	fmt.Printf("Patched %fMiB of %fMiB total in %v diffs\n",
+		toMiB(diffs.Differences), toMiB(diffs.Size), len(diffs.Diffs))
+}
+
+// apply applies the patch to the local alike into the destination
+func apply(patchfile, to, alike string) {
+	fmt.Printf("Applying patch %v\n", patchfile)
+	diffs, err := slicesync.ApplyPatch(patchfile, to, alike)
+	exitOnError(err)
+	fmt.Printf("Applied %fMiB of %fMiB total, sha1 %v verified\n",
+		toMiB(diffs.Differences), toMiB(diffs.Size), diffs.Hash)
+}
+
+func main() {
+	var createMode, applyMode, help bool
+	var patchfile, to, alike string
+	var slice int64
+	flag.BoolVar(&createMode, "create", false, "Create a patch from a local alike to a new local file or remote url")
+	flag.BoolVar(&applyMode, "apply", false, "Apply a patch to a local alike, verifying both the alike and the result")
+	flag.StringVar(&patchfile, "o", "", "(Optional) Patch file to create, the new file name + .patch.slicesync by default")
+	flag.Int64Var(&slice, "slice", slicesync.MiB, "(Optional) Slice size")
+	flag.StringVar(&to, "to", "", "(Optional) Local destination, the patched file name by default")
+	flag.StringVar(&alike, "alike", "", "(Optional) Local alike the patch applies to, the destination by default")
+	flag.BoolVar(&help, "help", false, "Show command help")
+	flag.Parse()
+	args := flag.Args()
+	if createMode && len(args) == 2 {
+		create(patchfile, args[0], args[1], slice)
+	} else if applyMode && len(args) == 1 {
+		apply(args[0], to, alike)
+	} else {
+		usage()
+	}
+}
@@ -2,49 +2,195 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"github.com/josvazg/slicesync"
 	"os"
 	"strconv"
+	"time"
 )
 
+// accessControl loads the access control files given, returning nil if there are none
+func accessControl(htpasswd, tokens, urlKey, rules string) (*slicesync.AccessControl, error) {
+	if htpasswd == "" && tokens == "" && urlKey == "" && rules == "" {
+		return nil, nil
+	}
+	ac := slicesync.NewAccessControl()
+	for _, load := range []struct {
+		file string
+		fn   func(string) error
+	}{{htpasswd, ac.LoadUsers}, {tokens, ac.LoadTokens}, {urlKey, ac.LoadURLKey}, {rules, ac.LoadRules}} {
+		if load.file == "" {
+			continue
+		}
+		if err := load.fn(load.file); err != nil {
+			return nil, err
+		}
+	}
+	return ac, nil
+}
+
 // Start the server on port 8000 by default
 func main() {
-	port := 8000
-	dir := "."
-	if len(os.Args) > 1 {
-		if os.Args[1] == "--help" {
-			usage()
+	var port int
+	var dir string
+	var slice int64
+	var nonrecursive, nocompress bool
+	var help bool
+	var sign, symlinks, accessLog string
+	var htpasswd, tokens, urlKey, rules, signURL string
+	var adminHtpasswd, adminTokens, adminRules string
+	var expires time.Duration
+	flag.IntVar(&port, "port", 8000, "Port to listen on")
+	flag.StringVar(&slicesync.BindAddress, "bind", "", "(Optional) Host or IP address to listen on, all interfaces by default")
+	flag.StringVar(&slicesync.CertFile, "tls-cert", "", "(Optional) PEM certificate file to serve HTTPS, reloaded on SIGHUP")
+	flag.StringVar(&slicesync.KeyFile, "tls-key", "", "(Optional) PEM private key file of the HTTPS certificate")
+	flag.StringVar(&slicesync.ClientCAFile, "client-ca", "",
+		"(Optional) PEM CA certificates file to require HTTPS client certificates signed by them")
+	flag.StringVar(&htpasswd, "htpasswd", "", "(Optional) htpasswd file of the users allowed, by basic auth ({SHA} or $apr1$)")
+	flag.StringVar(&tokens, "tokens", "", "(Optional) File of name:token lines with the bearer tokens allowed")
+	flag.StringVar(&urlKey, "url-key", "", "(Optional) Key file to sign and check expiring download urls")
+	flag.StringVar(&rules, "access", "", "(Optional) File of \"/path/prefix name...\" lines restricting access per path "+
+		"(names are users, tokens, * for anyone authenticated or public)")
+	flag.StringVar(&signURL, "sign-url", "", "Print this file url signed with the -url-key, instead of serving")
+	flag.DurationVar(&expires, "expires", 24*time.Hour, "Time the url from -sign-url remains valid")
+	flag.StringVar(&adminHtpasswd, "admin-htpasswd", "", "(Optional) htpasswd file of the admin API users")
+	flag.StringVar(&adminTokens, "admin-tokens", "", "(Optional) File of name:token lines with the admin API bearer tokens")
+	flag.StringVar(&adminRules, "admin-access", "",
+		"(Optional) File of \"/endpoint name...\" lines restricting access per admin API endpoint")
+	flag.IntVar(&slicesync.AdminPort, "admin-port", 0, "Port to serve the admin API on, the -port if 0")
+	flag.StringVar(&accessLog, "access-log", "", "(Optional) Access log file, - for the standard output")
+	flag.StringVar(&slicesync.AccessLogFormat, "log-format", slicesync.LOG_COMMON, "Access log format: common or json")
+	flag.StringVar(&slicesync.MetricsPath, "metrics", slicesync.MetricsPath,
+		"Path of the Prometheus metrics endpoint, none if empty")
+	flag.StringVar(&dir, "dir", ".", "Directory to hash and serve")
+	flag.Int64Var(&slice, "slice", slicesync.MiB, "Slice size")
+	flag.BoolVar(&nonrecursive, "non-recursive", false, "Do not hash and serve subdirectories")
+	flag.IntVar(&slicesync.HashWorkers, "workers", slicesync.HashWorkers, "Number of concurrent hashing workers")
+	flag.DurationVar(&slicesync.QuietPeriod, "quiet", slicesync.QuietPeriod,
+		"Time a file must remain unmodified before it is hashed")
+	flag.BoolVar(&slicesync.IncrementalHashing, "incremental", false,
+		"Only hash the appended tail of grown (append-only) files")
+	flag.BoolVar(&slicesync.ContentDefinedChunking, "cdc", false,
+		"Cut content defined chunks of slice size on average instead of fixed size slices")
+	flag.StringVar(&slicesync.SliceHashing, "hashing", slicesync.SliceHashing,
+		"Slice hashing algorithm: adler32+md5, buzhash+md5 or rabinkarp+md5")
+	flag.Int64Var(&slicesync.SubSlice, "subslice", 0, "(Optional) Sub-slice size to also hash within each slice")
+	flag.BoolVar(&slicesync.MerkleTree, "merkle", false,
+		"End hash dumps with a Merkle root over the slice hashes, to verify single slices")
+	flag.StringVar(&symlinks, "symlinks", slicesync.Symlinks.String(),
+		"Symlink policy: deny, within (only those resolving within the directory) or follow")
+	flag.BoolVar(&slicesync.ServeHidden, "hidden", false, "Serve and hash hidden files (named starting with '.')")
+	flag.DurationVar(&slicesync.ShutdownTimeout, "shutdown-timeout", slicesync.ShutdownTimeout,
+		"Time to wait for in-flight requests on SIGTERM, before shutting down")
+	flag.BoolVar(&nocompress, "no-compress", false, "Do not gzip responses, even if clients accept it")
+	flag.StringVar(&sign, "sign", "", "(Optional) Private key file to sign the hash dumps with (see skeygen)")
+	flag.BoolVar(&help, "help", false, "Show command help")
+	flag.Parse()
+	if help {
+		usage()
+		return
+	}
+	if _, ok := slicesync.SliceHashings[slicesync.SliceHashing]; !ok {
+		fmt.Printf("Unknown slice hashing %v!\n", slicesync.SliceHashing)
+		return
+	}
+	policy, err := slicesync.ParseSymlinkPolicy(symlinks)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	slicesync.Symlinks = policy
+	access, err := accessControl(htpasswd, tokens, urlKey, rules)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if signURL != "" {
+		if access == nil || len(access.URLKey) == 0 {
+			fmt.Println("An -url-key is required to sign urls!")
+			return
+		}
+		signed, err := slicesync.SignURL(signURL, access.URLKey, time.Now().Add(expires))
+		if err != nil {
+			fmt.Println(err)
 			return
 		}
+		fmt.Println(signed)
+		return
+	}
+	slicesync.Access = access
+	if slicesync.AdminAccess, err = accessControl(adminHtpasswd, adminTokens, "", adminRules); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if slicesync.AccessLogFormat != slicesync.LOG_COMMON && slicesync.AccessLogFormat != slicesync.LOG_JSON {
+		fmt.Printf("Unknown access log format %v!\n", slicesync.AccessLogFormat)
+		return
+	}
+	if accessLog == "-" {
+		slicesync.AccessLog = os.Stdout
+	} else if accessLog != "" {
+		logfile, err := os.OpenFile(accessLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer logfile.Close()
+		slicesync.AccessLog = logfile
+	}
+	if sign != "" {
+		key, err := slicesync.LoadSigningKey(sign)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		slicesync.SigningKey = key
+	}
+	// Positional arguments are still accepted as [port] [dir] [slice] [non-recursive]
+	args := flag.Args()
+	if len(args) > 0 {
 		var err error
-		port, err = strconv.Atoi(os.Args[1])
+		port, err = strconv.Atoi(args[0])
 		if err != nil {
-			fmt.Printf("First argument must be '--help' or a port number but got %v!\n", os.Args[1])
+			fmt.Printf("First argument must be a port number but got %v!\n", args[0])
 			usage()
 			return
 		}
 	}
-	if len(os.Args) > 2 {
-		dir = os.Args[2]
+	if len(args) > 1 {
+		dir = args[1]
 	}
-	slice := int64(slicesync.MiB)
-	if len(os.Args) > 3 {
-		slc, err := strconv.ParseInt(os.Args[3], 10, 64)
+	if len(args) > 2 {
+		slc, err := strconv.ParseInt(args[2], 10, 64)
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
 		slice = slc
 	}
-	recursive := true
-	if len(os.Args) > 4 {
-		recursive = !(os.Args[4] == "non-recursive")
+	if len(args) > 3 {
+		nonrecursive = args[3] == "non-recursive"
+	}
+	scheme := "http"
+	if slicesync.CertFile != "" {
+		scheme = "https"
+	}
+	fmt.Printf("Slicesync server (Hash&Dump) hashing&serving directory %v at %v://%v:%v...\n",
+		dir, scheme, slicesync.BindAddress, port)
+	if slicesync.AdminAccess != nil && slicesync.AdminPort != 0 && slicesync.AdminPort != port {
+		fmt.Printf("Admin API at %v://%v:%v%v\n", scheme, slicesync.BindAddress, slicesync.AdminPort,
+			slicesync.ADMIN_PATH)
+	}
+	slicesync.Compress = !nocompress
+	if err := slicesync.HashNServe(port, dir, slice, !nonrecursive); err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
 	}
-	fmt.Printf("Slicesync server (Hash&Dump) hashing&serving directory %v at port %v...\n", dir, port)
-	slicesync.HashNServe(port, dir, slice, recursive)
+	fmt.Println("Slicesync server shut down.")
 }
 
 func usage() {
-	fmt.Printf("Usage: %v [port] [dir] [slice] [-non-recursive] (or --help for this help)\n", os.Args[0])
+	fmt.Printf("Usage: %v [flags] [port] [dir] [slice] [non-recursive]\n", os.Args[0])
+	flag.PrintDefaults()
 }
@@ -0,0 +1,314 @@
+package slicesync
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// sliceDump is a fully read .slicesync hash dump
+type sliceDump struct {
+	Slice, Length int64
+	Hashing       string
+	Hashes        []string
+	Hash          string
+	Merkle        string // Merkle root, if any
+}
+
+// Tail appends to destfile the remote fileurl contents beyond destfile's current size,
+// as long as destfile is verified to be a prefix of the remote file by the leading remote slice hashes
+// (when both files end up with the same size as the remote hash dump, the whole file hash is checked as well)
+// While the remote file has no hash dump yet, as growing files are not hashed until quiescent (see QuietPeriod),
+// destfile is compared against the same remote bytes instead
+//
+// destfile is the local destination, same as the remote filename if empty
+func Tail(fileurl, destfile string) (*Diffs, error) {
+	server, filename, destfile, err := probeTail(fileurl, destfile)
+	if err != nil {
+		return nil, err
+	}
+	diffs, _, err := tail(server, filename, destfile, 0)
+	return diffs, err
+}
+
+// Follow keeps appending to destfile the new contents of the growing remote fileurl, like tail -f,
+// polling it every period until an error happens
+//
+// Each time new contents are appended, the applied Diffs are passed to fn, if not nil
+func Follow(fileurl, destfile string, period time.Duration, fn func(*Diffs)) error {
+	server, filename, destfile, err := probeTail(fileurl, destfile)
+	if err != nil {
+		return err
+	}
+	verified := int64(0)
+	for {
+		var diffs *Diffs
+		diffs, verified, err = tail(server, filename, destfile, verified)
+		if err != nil {
+			return err
+		}
+		if fn != nil && diffs.Differences > 0 {
+			fn(diffs)
+		}
+		time.Sleep(period)
+	}
+}
+
+// probeTail probes fileurl and defaults the destfile to the remote filename
+func probeTail(fileurl, destfile string) (server, filename, dest string, err error) {
+	if fileurl == "" {
+		return "", "", "", fmt.Errorf("Invalid empty URL!")
+	}
+	server, filename, err = Probe(fileurl)
+	if err != nil {
+		return "", "", "", err
+	}
+	if destfile == "" {
+		destfile = filepath.Base(filename)
+	}
+	return server, filename, destfile, nil
+}
+
+// tail appends to destfile the remote filename contents at server beyond destfile's size
+// Local slices are verified against the remote hash dump, or the remote bytes if there is no dump yet,
+// from offset verified on, and the new verified offset is returned along with the applied Diffs
+func tail(server, filename, destfile string, verified int64) (*Diffs, int64, error) {
+	lsize := int64(0)
+	if fi, err := os.Stat(destfile); err == nil {
+		lsize = fi.Size()
+	}
+	rsize, err := remoteSize(calcUrl(server, filename))
+	if err != nil {
+		return nil, verified, err
+	}
+	if rsize < lsize {
+		return nil, verified, fmt.Errorf("Remote %v shrank to %v bytes, but local %v has %v bytes!",
+			filename, rsize, destfile, lsize)
+	}
+	remoteHnd := &RemoteHashNDump{server}
+	dump, err := remoteSliceDump(server, filename)
+	if err != nil && !missingDump(server, filename) {
+		return nil, verified, err
+	}
+	if dump == nil {
+		return tailBytes(remoteHnd, filename, destfile, lsize, rsize, verified)
+	}
+	wholeCheck := verified == 0
+	if verified, err = verifyPrefix(destfile, remoteHnd, filename, dump, lsize, verified); err != nil {
+		return nil, verified, err
+	}
+	diffs := NewDiffs(server, filename, destfile, dump.Slice, rsize)
+	if lsize > 0 {
+		diffs.Diffs = append(diffs.Diffs, Diff{0, lsize, false})
+	}
+	if rsize > lsize {
+		diffs.Diffs = append(diffs.Diffs, Diff{lsize, rsize - lsize, true})
+		diffs.Differences = rsize - lsize
+		if err := appendRemote(destfile, calcUrl(server, filename), lsize, rsize-lsize); err != nil {
+			return nil, verified, err
+		}
+	}
+	if wholeCheck && rsize == dump.Length {
+		hash, err := fileHash(destfile)
+		if err != nil {
+			return nil, verified, err
+		}
+		if hash != dump.Hash {
+			return nil, verified, fmt.Errorf("Hash check failed: expected %v but got %v!", dump.Hash, hash)
+		}
+		diffs.Hash = hash
+	}
+	return diffs, verified, nil
+}
+
+// tailBytes performs tail's work for a remote filename without a hash dump, comparing the local destfile bytes
+// from offset verified on against the same remote bytes (those appended are the remote ones, so verified as well)
+func tailBytes(remoteHnd *RemoteHashNDump, filename, destfile string, lsize, rsize, verified int64) (
+	*Diffs, int64, error) {
+	diffs := NewDiffs(remoteHnd.Server, filename, destfile, 0, rsize)
+	if verified < lsize {
+		file, err := os.Open(destfile)
+		if err != nil {
+			return nil, verified, err
+		}
+		same := sameRemote(file, remoteHnd, filename, verified, lsize-verified)
+		file.Close()
+		if !same {
+			return nil, verified, fmt.Errorf("Local %v is not a prefix of the remote file, bytes from %v differ!",
+				destfile, verified)
+		}
+	}
+	verified = lsize
+	if lsize > 0 {
+		diffs.Diffs = append(diffs.Diffs, Diff{0, lsize, false})
+	}
+	if rsize > lsize {
+		diffs.Diffs = append(diffs.Diffs, Diff{lsize, rsize - lsize, true})
+		diffs.Differences = rsize - lsize
+		if err := appendRemote(destfile, calcUrl(remoteHnd.Server, filename), lsize, rsize-lsize); err != nil {
+			return nil, verified, err
+		}
+		verified = rsize
+	}
+	return diffs, verified, nil
+}
+
+// missingDump tells whether the server has no hash dump of filename (yet)
+func missingDump(server, filename string) bool {
+	r, err := http.DefaultClient.Head(calcUrl(server, SlicesyncFile(".", filename)))
+	if err != nil {
+		return false
+	}
+	r.Body.Close()
+	return r.StatusCode == http.StatusNotFound
+}
+
+// verifyPrefix checks the local destfile slices of size lsize against the remote hash dump from offset verified on
+// A partial last local slice is checked against the same remote filename bytes instead
+// It returns up to where destfile has been verified
+func verifyPrefix(destfile string, remoteHnd *RemoteHashNDump, filename string, dump *sliceDump,
+	lsize, verified int64) (int64, error) {
+	if lsize == 0 {
+		return verified, nil
+	}
+	file, err := os.Open(destfile)
+	if err != nil {
+		return verified, err
+	}
+	defer file.Close()
+	sliceHash, err := newSliceHasher(dump.Hashing)
+	if err != nil {
+		return verified, err
+	}
+	for i := verified / dump.Slice; i < int64(len(dump.Hashes)); i++ {
+		start := i * dump.Slice
+		end := min(start+dump.Slice, dump.Length)
+		if end > lsize {
+			if start < verified {
+				start = verified
+			}
+			if start < lsize && !sameRemote(file, remoteHnd, filename, start, lsize-start) {
+				return verified, fmt.Errorf("Local %v is not a prefix of the remote file, slice at %v differs!",
+					destfile, i*dump.Slice)
+			}
+			return lsize, nil
+		}
+		sliceHash.Reset()
+		if _, err := io.Copy(sliceHash, io.NewSectionReader(file, start, end-start)); err != nil {
+			return verified, err
+		}
+		if base64.StdEncoding.EncodeToString(sliceHash.Sum(nil)) != dump.Hashes[i] {
+			return verified, fmt.Errorf("Local %v is not a prefix of the remote file, slice at %v differs!",
+				destfile, start)
+		}
+		if end-start == dump.Slice {
+			verified = end
+		}
+	}
+	return verified, nil
+}
+
+// sameRemote tells whether the size bytes of file at offset are the same as those of the remote filename
+func sameRemote(file *os.File, remoteHnd *RemoteHashNDump, filename string, offset, size int64) bool {
+	r, n, err := remoteHnd.Dump(filename, offset, size)
+	if err != nil {
+		return false
+	}
+	defer r.Close()
+	remote, err := ioutil.ReadAll(r)
+	if err != nil || n != size || int64(len(remote)) != size {
+		return false
+	}
+	local, err := ioutil.ReadAll(io.NewSectionReader(file, offset, size))
+	return err == nil && bytes.Equal(local, remote)
+}
+
+// appendRemote appends size bytes from the remote url at offset pos to destfile
+// (a server ignoring the range would append the file from its start, so only a partial response is accepted then)
+func appendRemote(destfile, url string, pos, size int64) error {
+	r, resp, err := get(url, pos, size)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if pos > 0 && resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("Expected a partial response from %v at %v, but got %v!", url, pos, resp.Status)
+	}
+	w, err := os.OpenFile(destfile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0750)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	n, err := io.CopyN(w, r, size)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("Expected to append %v but appended %v instead!", size, n)
+	}
+	return nil
+}
+
+// fileHash returns the whole file hash of filename
+func fileHash(filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := NewHasher()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// remoteSliceDump reads the full remote hash dump for filename at server
+func remoteSliceDump(server, filename string) (*sliceDump, error) {
+	remoteHnd := &RemoteHashNDump{server}
+	rm, err := remoteHnd.Hash(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening remote diff source: %v", err)
+	}
+	defer rm.Close()
+	return readSliceDump(bufio.NewReader(rm), filename)
+}
+
+// readSliceDump reads a full hash dump, whatever its slice size (content defined chunks are not supported)
+func readSliceDump(r *bufio.Reader, filename string) (*sliceDump, error) {
+	header, err := readDumpHeader(r, filename)
+	if err != nil {
+		return nil, err
+	}
+	if header.Chunking != nil {
+		return nil, fmt.Errorf("Hash dump for %v is chunked, fixed size slices expected!", filename)
+	}
+	slice, size := header.Slice, header.Length
+	dump := &sliceDump{Slice: slice, Length: size, Hashing: header.Hashing}
+	for pos := int64(0); pos < size; pos += slice {
+		line, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		hash, _ := splitSubSlices(line)
+		dump.Hashes = append(dump.Hashes, hash)
+	}
+	if size > 0 {
+		if dump.Hash, err = readAttribute(r, NewHasher().Name()); err != nil {
+			return nil, err
+		}
+		if next, _ := r.Peek(len(MERKLE + ":")); string(next) == MERKLE+":" {
+			if dump.Merkle, err = readAttribute(r, MERKLE); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return dump, nil
+}
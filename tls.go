@@ -0,0 +1,116 @@
+package slicesync
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// BindAddress is the local host or IP address ServeHashNDump listens on, all interfaces when empty
+var BindAddress = ""
+
+// CertFile and KeyFile, when set, make ServeHashNDump serve HTTPS with that PEM certificate and key
+// (both files are loaded again on SIGHUP, so renewed certificates are served without restarting)
+var CertFile, KeyFile string
+
+// ClientCAFile, when set for HTTPS, makes ServeHashNDump require client certificates
+// signed by any of the PEM CA certificates in it
+var ClientCAFile string
+
+// certReloader keeps the current server certificate, loaded again from its files on demand
+type certReloader struct {
+	sync.RWMutex
+	certFile, keyFile string
+	cert              *tls.Certificate
+}
+
+// newCertReloader creates a certReloader with the certificate already loaded from certFile and keyFile
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	return cr, cr.reload()
+}
+
+// reload loads the certificate files again, keeping the previous certificate if they are not valid
+func (cr *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("Certificate %v error: %v", cr.certFile, err)
+	}
+	cr.Lock()
+	defer cr.Unlock()
+	cr.cert = &cert
+	return nil
+}
+
+// watch reloads the certificate each time a signal is received, until signals is closed
+func (cr *certReloader) watch(signals <-chan os.Signal) {
+	for range signals {
+		if err := cr.reload(); err != nil {
+			fmt.Fprint(os.Stderr, err.Error()+"\n")
+		}
+	}
+}
+
+// GetCertificate for tls.Config, returns the current certificate
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.RLock()
+	defer cr.RUnlock()
+	return cr.cert, nil
+}
+
+// serverTLSConfig returns the server TLS configuration getting certificates from cr,
+// requiring client certificates when there is a ClientCAFile
+func serverTLSConfig(cr *certReloader) (*tls.Config, error) {
+	config := &tls.Config{GetCertificate: cr.GetCertificate, MinVersion: tls.VersionTLS12}
+	if ClientCAFile != "" {
+		pool, err := loadCertPool(ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// loadCertPool loads the PEM CA certificates in caFile
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No PEM certificates found in %v!", caFile)
+	}
+	return pool, nil
+}
+
+// ClientTLS configures the HTTPS connections to servers: certFile and keyFile, when set, hold the PEM
+// client certificate presented to servers requiring one, and caFile, when set, the PEM CA certificates
+// trusted to sign the server certificates instead of the system ones
+func ClientTLS(certFile, keyFile, caFile string) error {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("Client certificate %v error: %v", certFile, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return err
+		}
+		config.RootCAs = pool
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	http.DefaultClient.Transport = transport
+	return nil
+}
@@ -0,0 +1,197 @@
+package slicesync
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Verify audits the local filename against the hash dump of its published version, without downloading anything
+//
+// source is either a local .slicesync hash dump file, if it exists, or the remote fileurl
+// The returned Diffs mark the bad ranges of filename as Different,
+// the published whole file Hash and the local file hash as AlikeHash
+// (filename matches when there are no Differences and both hashes are the same, see Verified)
+func Verify(source, filename string) (*Diffs, error) {
+	var server, published string
+	var dump io.ReadCloser
+	var err error
+	if !exists(source) {
+		if server, published, err = Probe(source); err != nil {
+			return nil, err
+		}
+		remoteHnd := &RemoteHashNDump{server}
+		dump, err = remoteHnd.Hash(published)
+	} else {
+		published = dumpedFile(source)
+		if dump, err = os.Open(source); err == nil {
+			dump, err = trustedDump(dump, published)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error opening hash dump: %v", err)
+	}
+	defer dump.Close()
+	remote := bufio.NewReader(dump)
+	header, err := readDumpHeader(remote, published)
+	if err != nil {
+		return nil, fmt.Errorf("Hash dump header error: %v", err)
+	}
+	if header.Chunking != nil {
+		return nil, fmt.Errorf("Hash dump for %v is chunked, fixed size slices expected!", published)
+	}
+	sliceHash, err := newSliceHasher(header.Hashing)
+	if err != nil {
+		return nil, err
+	}
+	lc, err := hashStream(filename, header.Slice, sliceHash)
+	if err != nil {
+		return nil, err
+	}
+	defer lc.Close()
+	diffs := NewDiffs(server, published, filename, header.Slice, header.Length)
+	return naiveDiffs(diffs, bufio.NewReader(lc), remote, header)
+}
+
+// Verified tells whether the audited file matched its published version in the Diffs returned by Verify
+func Verified(diffs *Diffs, filename string) bool {
+	fi, err := os.Stat(filename)
+	return err == nil && fi.Size() == diffs.Size && diffs.Differences == 0 && diffs.Hash == diffs.AlikeHash
+}
+
+// SliceRetries is the number of times a slice failing verification is downloaded again
+var SliceRetries = 2
+
+// SliceError reports the exact ranges that failed slice verification, even after retrying them
+type SliceError struct {
+	Ranges []Diff
+}
+
+// Error for SliceError's error implementation
+func (e *SliceError) Error() string {
+	ranges := make([]string, len(e.Ranges))
+	for i, r := range e.Ranges {
+		ranges[i] = fmt.Sprintf("%v-%v", r.Offset, r.Offset+r.Size)
+	}
+	return fmt.Sprintf("Slice verification failed at %v!", strings.Join(ranges, ", "))
+}
+
+// sliceVerifier hashes the slices written to it to check them against the remote slice hashes
+type sliceVerifier struct {
+	subSlicer
+	diffs *Diffs
+}
+
+// newSliceVerifier returns a sliceVerifier for diffs, or nil if diffs has no remote slice hashes for all its slices
+func newSliceVerifier(diffs *Diffs) *sliceVerifier {
+	if diffs.Slice <= 0 || int64(len(diffs.Hashes)) != (diffs.Size+diffs.Slice-1)/diffs.Slice {
+		return nil
+	}
+	sliceHash, err := newSliceHasher(diffs.Hashing)
+	if err != nil {
+		return nil
+	}
+	return &sliceVerifier{subSlicer{hash: sliceHash, sub: diffs.Slice}, diffs}
+}
+
+// fetchedSliceVerifier returns a sliceVerifier of filename, written following diffs without slice hashes,
+// with the remote slice hashes fetched from the diffs Server, or nil if they can not be fetched
+func fetchedSliceVerifier(filename string, diffs *Diffs) *sliceVerifier {
+	if diffs.Server == "" {
+		return nil
+	}
+	dump, err := remoteSliceDump(diffs.Server, diffs.Filename)
+	if err != nil || dump.Slice != diffs.Slice || dump.Hash != diffs.Hash {
+		return nil
+	}
+	fetched := *diffs
+	fetched.Hashing, fetched.Hashes = dump.Hashing, dump.Hashes
+	verifier := newSliceVerifier(&fetched)
+	if verifier == nil {
+		return nil
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	if _, err := io.Copy(verifier, file); err != nil {
+		return nil
+	}
+	return verifier
+}
+
+// bad returns the ranges of the slices written that do not match the remote slice hashes
+func (v *sliceVerifier) bad() []Diff {
+	bad := NewDiffs("", "", "", v.diffs.Slice, v.diffs.Size)
+	hashes := v.take()
+	for i, expected := range v.diffs.Hashes {
+		if i >= len(hashes) || hashes[i] != expected {
+			offset := int64(i) * v.diffs.Slice
+			bad.add(Diff{offset, min(v.diffs.Slice, v.diffs.Size-offset), true})
+		}
+	}
+	return bad.Diffs
+}
+
+// retrySlices downloads again, up to SliceRetries times, the slices in the bad ranges of file
+// and writes them in place once they match their remote slice hash
+// It returns the ranges still bad
+func retrySlices(file *os.File, diffs *Diffs, bad []Diff) []Diff {
+	if diffs.Server == "" {
+		return bad
+	}
+	remoteHnd := &RemoteHashNDump{diffs.Server}
+	stillBad := NewDiffs("", "", "", diffs.Slice, diffs.Size)
+	for _, r := range bad {
+		for offset := r.Offset; offset < r.Offset+r.Size; offset += diffs.Slice {
+			size := min(diffs.Slice, diffs.Size-offset)
+			if !retrySlice(file, remoteHnd, diffs, offset, size) {
+				stillBad.add(Diff{offset, size, true})
+			}
+		}
+	}
+	return stillBad.Diffs
+}
+
+// retrySlice downloads again the slice at offset until it matches its remote slice hash, and writes it into file
+func retrySlice(file *os.File, remoteHnd *RemoteHashNDump, diffs *Diffs, offset, size int64) bool {
+	sliceHash, err := newSliceHasher(diffs.Hashing)
+	if err != nil {
+		return false
+	}
+	for i := 0; i < SliceRetries; i++ {
+		source, _, err := remoteHnd.Dump(diffs.Filename, offset, size)
+		if err != nil {
+			continue
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(source, size))
+		source.Close()
+		if err != nil || int64(len(data)) != size {
+			continue
+		}
+		if chunkHash(sliceHash, data) != diffs.Hashes[offset/diffs.Slice] {
+			continue
+		}
+		_, err = file.WriteAt(data, offset)
+		return err == nil
+	}
+	return false
+}
+
+// dumpedFile returns the path of the file the local hash dump hfilename is for, relative to the directory
+// holding the hash dumps directory, or just its name if hfilename is not within a hash dumps directory
+func dumpedFile(hfilename string) string {
+	elems := strings.Split(filepath.ToSlash(hfilename), "/")
+	for i := len(elems) - 2; i >= 0; i-- {
+		if elems[i] == SlicesyncDir {
+			return strings.TrimSuffix(path.Join(elems[i+1:]...), SliceSyncExt)
+		}
+	}
+	return strings.TrimSuffix(filepath.Base(hfilename), SliceSyncExt)
+}
@@ -0,0 +1,175 @@
+package slicesync
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+const (
+	MAX_RANGE_HASHES = 65536 // Maximum number of slice hashes returned for a single range
+)
+
+// ZoomSlice, when not 0, makes Slicesync zoom into the different regions to find their different slices
+// of this smaller size, with hashes calculated on demand by the server (see Zoom)
+var ZoomSlice int64 = 0
+
+// HashRange dumps the slice hashes of filename's range from offset up to size bytes, on the fly,
+// in the .slicesync format with an additional Offset attribute and the hash of the range at the end
+func (hnd *LocalHashNDump) HashRange(filename string, offset, size, slice int64) (rc io.ReadCloser, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); ok {
+				panic(r)
+			}
+			err = r.(error)
+		}
+	}()
+	if offset < 0 || size < 0 || slice <= 0 {
+		return nil, fmt.Errorf("Invalid range %v+%v or slice %v!", offset, size, slice)
+	}
+	lrc := dump(calcpath(hnd.Dir, filename), offset, size)
+	if lrc.N < 0 {
+		lrc.Close()
+		return nil, fmt.Errorf("Range offset %v is beyond the end of %v!", offset, filename)
+	}
+	if (lrc.N+slice-1)/slice > MAX_RANGE_HASHES {
+		lrc.Close()
+		return nil, fmt.Errorf("Too many slices of %v bytes requested for %v bytes!", slice, lrc.N)
+	}
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(hashRangeDump(w, lrc, filename, offset, lrc.N, slice, NewSliceHasher()))
+	}()
+	return r, nil
+}
+
+// hashRangeDump produces the Hash dump output of a file range into the given writer, hashing slices with sliceHash
+func hashRangeDump(w io.Writer, file io.ReadCloser, filename string, offset, size, slice int64,
+	sliceHash NamedHash) error {
+	defer file.Close()
+	bufW := bufio.NewWriterSize(w, bufferSize)
+	defer bufW.Flush()
+	h := NewHasher()
+	fmt.Fprintf(bufW, "Version: %v\n", Version)
+	fmt.Fprintf(bufW, "Filename: %v\n", filepath.Base(filename))
+	fmt.Fprintf(bufW, "Slice: %v\n", slice)
+	fmt.Fprintf(bufW, "Slice Hashing: %v\n", sliceHash.Name())
+	fmt.Fprintf(bufW, "Offset: %v\n", offset)
+	fmt.Fprintf(bufW, "Length: %v\n", size)
+	hashSink := io.MultiWriter(h, sliceHash)
+	for pos := int64(0); pos < size; pos += slice {
+		if _, err := io.CopyN(hashSink, file, min(slice, size-pos)); err != nil {
+			fmt.Fprintf(bufW, "Error:%s\n", err)
+			return err
+		}
+		fmt.Fprintf(bufW, "%s\n", base64.StdEncoding.EncodeToString(sliceHash.Sum(nil)))
+		sliceHash.Reset()
+	}
+	fmt.Fprintf(bufW, "%v: %x\n", h.Name(), h.Sum(nil))
+	return bufW.Flush()
+}
+
+// HashRange returns the remote stream of slice hashes for a range of filename, calculated on demand
+// (only servers supporting the "hashes" slicesync extension can do it, such as syncserver)
+func (rhnd *RemoteHashNDump) HashRange(filename string, offset, size, slice int64) (io.ReadCloser, error) {
+	if !supports(rhnd.Server, HASHES) {
+		return nil, fmt.Errorf("Remote server %v does not calculate slice hashes on demand!", rhnd.Server)
+	}
+	query := url.Values{}
+	query.Set(SLICESYNC_PARAM, HASHES)
+	query.Set("offset", fmt.Sprintf("%v", offset))
+	query.Set("length", fmt.Sprintf("%v", size))
+	query.Set("slice", fmt.Sprintf("%v", slice))
+	r, _, err := get(calcUrl(rhnd.Server, filename)+"?"+query.Encode(), 0, 0)
+	return r, err
+}
+
+// readRangeHashes reads a full range hash dump as produced by HashRange
+func readRangeHashes(r *bufio.Reader, filename string) (*dumpHeader, []string, error) {
+	header, err := readDumpHeader(r, filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	hashes := make([]string, 0, (header.Length+header.Slice-1)/header.Slice)
+	for pos := int64(0); pos < header.Length; pos += header.Slice {
+		hash, err := readString(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	if _, err := readAttribute(r, NewHasher().Name()); err != nil {
+		return nil, nil, err
+	}
+	return header, hashes, nil
+}
+
+// Zoom narrows down each different region in diffs, larger than subslice, to its different subslices,
+// comparing the remote slice hashes calculated on demand by the server with the same local alike slices
+//
+// Only Diffs matching positions, such as those from NaiveDiffs, can be zoomed into
+func Zoom(diffs *Diffs, subslice int64) error {
+	if subslice <= 0 {
+		return fmt.Errorf("Invalid zoom slice %v!", subslice)
+	}
+	if !diffs.positional() {
+		return fmt.Errorf("Diffs do not match positions, they can not be zoomed into!")
+	}
+	fi, err := os.Stat(diffs.Alike)
+	if err != nil {
+		return err
+	}
+	alikeSize := fi.Size()
+	remoteHnd := &RemoteHashNDump{diffs.Server}
+	zoomed := NewDiffs(diffs.Server, diffs.Filename, diffs.Alike, diffs.Slice, diffs.Size)
+	zoomed.Hash, zoomed.AlikeHash = diffs.Hash, diffs.AlikeHash
+	zoomed.Hashing, zoomed.Hashes = diffs.Hashing, diffs.Hashes
+	for _, diff := range diffs.Diffs {
+		if !diff.Different || diff.Size <= subslice || diff.Offset >= alikeSize {
+			zoomed.add(diff)
+			if diff.Different {
+				zoomed.Differences += diff.Size
+			}
+			continue
+		}
+		if err := zoomInto(zoomed, remoteHnd, diff, subslice, alikeSize); err != nil {
+			return err
+		}
+	}
+	*diffs = *zoomed
+	return nil
+}
+
+// zoomInto adds to zoomed the different diff narrowed down to its different subslices
+func zoomInto(zoomed *Diffs, remoteHnd *RemoteHashNDump, diff Diff, subslice, alikeSize int64) error {
+	rc, err := remoteHnd.HashRange(zoomed.Filename, diff.Offset, diff.Size, subslice)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	header, hashes, err := readRangeHashes(bufio.NewReader(rc), zoomed.Filename)
+	if err != nil {
+		return err
+	}
+	if header.Offset != diff.Offset || header.Length != diff.Size {
+		return fmt.Errorf("Expected hashes for %v+%v but got %v+%v!",
+			diff.Offset, diff.Size, header.Offset, header.Length)
+	}
+	narrower := newNarrower(zoomed.Alike, &dumpHeader{Hashing: header.Hashing, SubSlice: header.Slice})
+	defer narrower.Close()
+	end := min(diff.Offset+diff.Size, alikeSize)
+	if err := narrower.narrow(zoomed, hashes, diff.Offset, diff.Offset+diff.Size, end); err != nil {
+		return err
+	}
+	if remaining := diff.Offset + diff.Size - end; remaining > 0 {
+		zoomed.add(Diff{end, remaining, true})
+		zoomed.Differences += remaining
+	}
+	return nil
+}